@@ -2,7 +2,10 @@ package command
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"sync"
@@ -16,6 +19,37 @@ type AppService struct {
 	Args []string
 	Env  []string
 	Cmd  *exec.Cmd
+
+	// Stdin feeds the child, when nil Input is used instead; a reader is consumed by the first run
+	Stdin io.Reader
+	Input string
+
+	// Script runs inline source with Interpreter (sh by default) instead of Name,
+	// Args are passed to the script. The temp file is removed after the run.
+	Script      string
+	Interpreter string
+
+	// ReplaceEnv makes Env the whole environment instead of overriding os.Environ()
+	ReplaceEnv bool
+
+	// Sinks receive output lines from Run, StartCommandPipe and StartCommandPipeCh
+	Sinks []Sink
+
+	// MaxOutput caps the bytes captured per stream by Run, 0 means DefaultMaxOutput, < 0 unlimited
+	MaxOutput int
+
+	// StopSignal is sent by Stop before escalating to SIGKILL, 0 means SIGTERM
+	StopSignal syscall.Signal
+
+	// Limits are applied by Run, nil runs the command unrestricted
+	Limits *Limits
+
+	// Recorder keeps the metadata and output of every Run when set
+	Recorder *Recorder
+
+	mu      sync.Mutex
+	done    chan struct{}
+	onStart func(pid int)
 }
 
 func (c *AppService) StdOutPipe() {
@@ -53,141 +87,42 @@ func (c *AppService) StdErrPipe() {
 }
 
 func (c *AppService) StartCommandStd() {
-	shell := exec.Command(c.Name, c.Args...)
-	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	shell.Dir = c.Home
-	shell.Env = c.Env
-	c.Cmd = shell
-	shell.Stdout = os.Stdout
-	shell.Stderr = os.Stderr
-	shell.Run()
-}
-
-func (c *AppService) StartCommandPipe() {
-	shell := exec.Command(c.Name, c.Args...)
-	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	shell.Dir = c.Home
-	shell.Env = c.Env
-	c.Cmd = shell
-
-	// 异步
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// stdout
-	pipeOut, pipeOutErr := c.Cmd.StdoutPipe()
-	if pipeOutErr != nil {
-		fmt.Println("pipeOutErr, ", pipeOutErr)
-		return
-	}
-	pipeOutScan := bufio.NewScanner(pipeOut)
-	pipeOutScanBuf := make([]byte, 0, bufio.MaxScanTokenSize*10)
-	pipeOutScan.Buffer(pipeOutScanBuf, cap(pipeOutScanBuf)*10)
-	go func() {
-		defer wg.Done()
-		for pipeOutScan.Scan() {
-			fmt.Println("pipeOutScan, ", pipeOutScan.Text())
-		}
-	}()
-	pipeOutScanErr := pipeOutScan.Err()
-	if pipeOutScanErr != nil {
-		fmt.Println("pipeOutScanErr, ", pipeOutScanErr)
-		return
-	}
-
-	// stderr
-	pipeErr, pipeErrErr := c.Cmd.StderrPipe()
-	if pipeErrErr != nil {
-		fmt.Println("pipeErrErr, ", pipeErrErr)
-		return
-	}
-	pipeErrScan := bufio.NewScanner(pipeErr)
-	pipeErrScanBuf := make([]byte, 0, bufio.MaxScanTokenSize*10)
-	pipeErrScan.Buffer(pipeErrScanBuf, cap(pipeErrScanBuf)*10)
-	go func() {
-		defer wg.Done()
-		for pipeErrScan.Scan() {
-			fmt.Println("pipeErrScan, ", pipeErrScan.Text())
-		}
-	}()
-	pipeErrScanErr := pipeErrScan.Err()
-	if pipeErrScanErr != nil {
-		fmt.Println("pipeErrScanErr, ", pipeErrScanErr)
+	shell, cleanup, err := c.command(context.Background(), nil)
+	if err != nil {
+		fmt.Println("commandErr, ", err)
 		return
 	}
-
-	// run
-	runErr := shell.Run()
-	if runErr != nil {
-		fmt.Println("runErr, ", runErr)
+	defer cleanup()
+	shell.Stdout = os.Stdout
+	shell.Stderr = os.Stderr
+	if err := c.start(shell); err != nil {
+		fmt.Println("startErr, ", err)
 		return
 	}
-	wg.Wait()
-
-	defer c.stopCommand()
+	c.wait(shell)
 }
 
-func (c *AppService) StartCommandPipeCh() {
-	shell := exec.Command(c.Name, c.Args...)
-	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	shell.Dir = c.Home
-	shell.Env = c.Env
-	c.Cmd = shell
-
-	// 异步
-	var wg sync.WaitGroup
-	wg.Add(2)
-
-	// stdout
-	pipeOut, pipeOutErr := c.Cmd.StdoutPipe()
-	if pipeOutErr != nil {
-		fmt.Println("pipeOutErr, ", pipeOutErr)
-		return
-	}
-	pipeOutScan := bufio.NewScanner(pipeOut)
-	pipeOutScanBuf := make([]byte, 0, bufio.MaxScanTokenSize*10)
-	pipeOutScan.Buffer(pipeOutScanBuf, cap(pipeOutScanBuf)*10)
-	go func() {
-		defer wg.Done()
-		for pipeOutScan.Scan() {
-			fmt.Println("pipeOutScan, ", pipeOutScan.Text())
-		}
-	}()
-	pipeOutScanErr := pipeOutScan.Err()
-	if pipeOutScanErr != nil {
-		fmt.Println("pipeOutScanErr, ", pipeOutScanErr)
-		return
+// StartCommandPipe streams output lines to c.Sinks, or prints them when no sink is set.
+func (c *AppService) StartCommandPipe() {
+	sinks := c.Sinks
+	if len(sinks) == 0 {
+		sinks = []Sink{NewWriterSink(os.Stdout, true)}
 	}
+	c.startCommandSinks(sinks)
+}
 
-	// stderr
-	pipeErr, pipeErrErr := c.Cmd.StderrPipe()
-	if pipeErrErr != nil {
-		fmt.Println("pipeErrErr, ", pipeErrErr)
-		return
-	}
-	pipeErrScan := bufio.NewScanner(pipeErr)
-	pipeErrScanBuf := make([]byte, 0, bufio.MaxScanTokenSize*10)
-	pipeErrScan.Buffer(pipeErrScanBuf, cap(pipeErrScanBuf)*10)
-	go func() {
-		defer wg.Done()
-		for pipeErrScan.Scan() {
-			fmt.Println("pipeErrScan, ", pipeErrScan.Text())
-		}
-	}()
-	pipeErrScanErr := pipeErrScan.Err()
-	if pipeErrScanErr != nil {
-		fmt.Println("pipeErrScanErr, ", pipeErrScanErr)
-		return
-	}
+// StartCommandPipeCh streams output lines to ch in addition to c.Sinks, blocking when ch is full.
+func (c *AppService) StartCommandPipeCh(ch chan<- Line) {
+	sinks := append([]Sink{NewChanSink(ch, true)}, c.Sinks...)
+	c.startCommandSinks(sinks)
+}
 
-	// run
-	runErr := shell.Run()
+func (c *AppService) startCommandSinks(sinks []Sink) {
+	_, runErr := c.run(context.Background(), sinks, nil)
 	if runErr != nil {
 		fmt.Println("runErr, ", runErr)
 		return
 	}
-	wg.Wait()
-
 	defer c.stopCommand()
 }
 
@@ -196,14 +131,30 @@ func (c *AppService) stopCommand() {
 	syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGKILL)
 }
 
-func (c *AppService) StopCommand() {
-	fmt.Println("外部退出, ", c.Cmd.ProcessState.String(), c.Cmd.ProcessState.ExitCode())
-	syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGKILL)
+// StopCommand kills the process group right away, use Stop for a graceful shutdown.
+// It returns StopNotRunning when the run is already over.
+func (c *AppService) StopCommand() (StopStep, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Cmd == nil || c.done == nil {
+		return StopNotRunning, ErrNotStarted
+	}
+	// the group id of a reaped run may already belong to someone else
+	select {
+	case <-c.done:
+		return StopNotRunning, nil
+	default:
+	}
+	if err := syscall.Kill(-c.Cmd.Process.Pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return StopNotRunning, err
+	}
+	return StopByKill, nil
 }
 
 func (c *AppService) Demo() {
 	fmt.Println(">>>>>>>>>>>>>>>>>>>>>>>>>")
 	go c.StartCommandPipe()
 	time.Sleep(time.Second * 10)
-	c.StopCommand()
+	step, err := c.StopCommand()
+	fmt.Println("外部退出, ", step, err)
 }
@@ -0,0 +1,518 @@
+package command
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	LimitShim()
+	os.Exit(m.Run())
+}
+
+func TestAppService_Run(t *testing.T) {
+	app := AppService{Name: "sh", Args: []string{"-c", "echo out; echo err >&2; exit 3"}}
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if result.ExitCode != 3 || result.Success() {
+		t.Errorf("exit code = %d, want 3", result.ExitCode)
+	}
+	if string(result.Stdout) != "out\n" || string(result.Stderr) != "err\n" {
+		t.Errorf("stdout = %q, stderr = %q", result.Stdout, result.Stderr)
+	}
+}
+
+func TestAppService_RunMaxOutput(t *testing.T) {
+	app := AppService{Name: "sh", Args: []string{"-c", "printf 0123456789"}, MaxOutput: 4}
+	result, err := app.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if string(result.Stdout) != "0123" || !result.StdoutTruncated {
+		t.Errorf("stdout = %q, truncated = %v", result.Stdout, result.StdoutTruncated)
+	}
+}
+
+func TestAppService_RunCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	// the grandchild sleep shares the process group and must die with it
+	app := AppService{Name: "sh", Args: []string{"-c", "sleep 30 & wait"}}
+	start := time.Now()
+	result, err := app.Run(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if result.Signal != syscall.SIGKILL {
+		t.Errorf("signal = %v, want SIGKILL", result.Signal)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Errorf("Run took %s after cancel", elapsed)
+	}
+}
+
+func TestAppService_RunCancelSetsid(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	// the sleep runs in its own session, outside the killed group, and holds stdout
+	app := AppService{Name: "sh", Args: []string{"-c", "setsid sleep 10 & wait"}}
+	start := time.Now()
+	if _, err := app.Run(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want deadline exceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > waitDelay+time.Second*2 {
+		t.Errorf("Run took %s after cancel", elapsed)
+	}
+}
+
+func TestAppService_RunSinks(t *testing.T) {
+	ring := NewRingSink(2)
+	ch := make(chan Line, 10)
+	app := AppService{
+		Name:  "sh",
+		Args:  []string{"-c", "echo a; echo b >&2; printf c"},
+		Sinks: []Sink{ring, NewChanSink(ch, false)},
+	}
+	if _, err := app.Run(context.Background()); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	close(ch)
+	var seq uint64
+	var texts []string
+	for line := range ch {
+		if line.Seq <= seq {
+			t.Errorf("seq %d after %d", line.Seq, seq)
+		}
+		seq = line.Seq
+		texts = append(texts, line.Stream+":"+line.Text)
+	}
+	if len(texts) != 3 {
+		t.Fatalf("lines = %v, want 3", texts)
+	}
+	if lines := ring.Lines(); len(lines) != 2 || lines[1].Seq != 3 {
+		t.Errorf("ring = %v", lines)
+	}
+}
+
+func TestRotateFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.log")
+	sink := NewRotateFileSink(path, 64, 2)
+	defer sink.Close()
+	for i := 0; i < 10; i++ {
+		if err := sink.WriteLine(Line{Stream: StreamStdout, Time: time.Now(), Text: "line"}); err != nil {
+			t.Fatalf("WriteLine: %v", err)
+		}
+	}
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		if _, err := os.Stat(name); err != nil {
+			t.Errorf("stat %s: %v", name, err)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 should not exist", path)
+	}
+}
+
+func TestAppService_Stop(t *testing.T) {
+	cases := []struct {
+		name   string
+		script string
+		want   StopStep
+	}{
+		{"signal", "trap 'exit 0' TERM; while :; do sleep 0.1; done", StopBySignal},
+		{"kill", "trap '' TERM; while :; do sleep 0.1; done", StopByKill},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			app := &AppService{Name: "sh", Args: []string{"-c", tc.script}}
+			if _, err := app.Stop(context.Background(), 0); err != ErrNotStarted {
+				t.Fatalf("Stop before start: %v", err)
+			}
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				app.Run(context.Background())
+			}()
+			// give the shell time to install its trap
+			time.Sleep(time.Millisecond * 300)
+			step, err := app.Stop(context.Background(), time.Millisecond*500)
+			if err != nil || step != tc.want {
+				t.Errorf("Stop = %v, %v, want %v", step, err, tc.want)
+			}
+			<-done
+			if step, _ := app.Stop(context.Background(), 0); step != StopNotRunning {
+				t.Errorf("Stop after exit = %v", step)
+			}
+		})
+	}
+}
+
+func TestAppService_StopCommand(t *testing.T) {
+	app := &AppService{Name: "sleep", Args: []string{"30"}}
+	if _, err := app.StopCommand(); err != ErrNotStarted {
+		t.Fatalf("StopCommand before start: %v", err)
+	}
+	done := make(chan *Result)
+	go func() {
+		result, _ := app.Run(context.Background())
+		done <- result
+	}()
+	time.Sleep(time.Millisecond * 100)
+	if step, err := app.StopCommand(); err != nil || step != StopByKill {
+		t.Errorf("StopCommand = %v, %v", step, err)
+	}
+	if result := <-done; result.Signal != syscall.SIGKILL {
+		t.Errorf("signal = %v, want SIGKILL", result.Signal)
+	}
+	if step, err := app.StopCommand(); err != nil || step != StopNotRunning {
+		t.Errorf("StopCommand after exit = %v, %v", step, err)
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	var mu sync.Mutex
+	var states []State
+	sup := NewSupervisor(func(event Event) {
+		if event.Child == "flaky" {
+			mu.Lock()
+			states = append(states, event.State)
+			mu.Unlock()
+		}
+	})
+	backoff := Backoff{Initial: time.Millisecond * 10, Max: time.Millisecond * 50}
+	if err := sup.Add(ChildSpec{
+		Name:        "flaky",
+		Service:     &AppService{Name: "sh", Args: []string{"-c", "exit 1"}},
+		Restart:     RestartOnFailure,
+		Backoff:     backoff,
+		MaxRestarts: 2,
+		Window:      time.Minute,
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := sup.Add(ChildSpec{
+		Name:      "daemon",
+		Service:   &AppService{Name: "sleep", Args: []string{"30"}},
+		Restart:   RestartAlways,
+		Backoff:   backoff,
+		StopGrace: time.Second,
+	}); err != nil {
+		t.Fatalf("Add: %v", err)
+	}
+	if err := sup.Start(context.Background()); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		status := sup.Status()
+		if status[0].State == StateFailed && status[1].State == StateRunning {
+			if status[0].LastErr != ErrTooManyRestarts || status[0].Restarts != 2 {
+				t.Errorf("flaky = %+v", status[0])
+			}
+			if status[1].Pid == 0 {
+				t.Errorf("daemon pid not set")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("status = %+v", status)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	flaky := sup.children["flaky"]
+	<-flaky.exited
+	if flaky.ctx.Err() == nil {
+		t.Errorf("context of the failed child still live")
+	}
+
+	sup.Stop(context.Background())
+	if state := sup.Status()[1].State; state != StateStopped {
+		t.Errorf("daemon state = %v, want stopped", state)
+	}
+	if err := sup.Add(ChildSpec{Name: "late", Service: &AppService{Name: "true"}}); err != ErrSupervisorStopped {
+		t.Errorf("Add after Stop = %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(states) == 0 || states[len(states)-1] != StateFailed {
+		t.Errorf("flaky events = %v", states)
+	}
+}
+
+func TestSupervisor_StopDuringRestart(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	var sup *Supervisor
+	stopped := make(chan struct{})
+	sup = NewSupervisor(func(event Event) {
+		// Stop lands after the restart checked for it and before the next run starts
+		if event.State == StateStarting && event.Restarts == 1 {
+			go func() {
+				sup.Stop(context.Background())
+				close(stopped)
+			}()
+			<-sup.children["busy"].stop
+			time.Sleep(time.Millisecond * 50)
+		}
+	})
+	sup.Add(ChildSpec{
+		Name:    "busy",
+		Service: &AppService{Name: "sh", Args: []string{"-c", "[ -e " + marker + " ] && exec sleep 30; touch " + marker}},
+		Restart: RestartAlways,
+		Backoff: Backoff{Initial: time.Millisecond, Max: time.Millisecond},
+	})
+	sup.Start(context.Background())
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Stop hangs on a restarting child, status %+v", sup.Status())
+	}
+	if state := sup.Status()[0].State; state != StateStopped {
+		t.Errorf("state = %v, want stopped", state)
+	}
+}
+
+func TestAppService_RunLimits(t *testing.T) {
+	app := AppService{Name: "sleep", Args: []string{"10"}, Limits: &Limits{Timeout: time.Millisecond * 100}}
+	_, err := app.Run(context.Background())
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != LimitTimeout {
+		t.Errorf("timeout err = %v", err)
+	}
+
+	app = AppService{Name: "sh", Args: []string{"-c", "while :; do :; done"}, Limits: &Limits{CPU: time.Second}}
+	_, err = app.Run(context.Background())
+	if limitErr, ok := err.(*LimitError); !ok || limitErr.Limit != LimitCPU {
+		t.Errorf("cpu err = %v", err)
+	}
+
+	// set before exec, so the first instruction and every fork already see them
+	for i := 0; i < 20; i++ {
+		app = AppService{Name: "sh", Args: []string{"-c", "ulimit -n; sh -c 'ulimit -Hn'"}, Limits: &Limits{OpenFiles: 64}}
+		result, err := app.Run(context.Background())
+		if err != nil || string(result.Stdout) != "64\n64\n" {
+			t.Fatalf("open files = %q, %v", result.Stdout, err)
+		}
+	}
+
+	// without a cgroup only the command itself sees the rlimit
+	app = AppService{Name: "sh", Args: []string{"-c", "exec 3</dev/null"}, Limits: &Limits{OpenFiles: 3}}
+	result, err := app.Run(context.Background())
+	if err != nil || result.Success() {
+		t.Errorf("over open files = %+v, %v", result, err)
+	}
+
+	app = AppService{Name: "true", Limits: &Limits{OpenFiles: 1 << 62}}
+	if _, err := app.Run(context.Background()); err == nil {
+		t.Errorf("open files above the hard limit accepted")
+	}
+
+	t.Setenv("GTOOLS_KEEP", "1")
+	t.Setenv("GTOOLS_DROP", "1")
+	app = AppService{
+		Name:   "sh",
+		Args:   []string{"-c", "echo $GTOOLS_KEEP$GTOOLS_DROP$EXTRA"},
+		Env:    []string{"EXTRA=2"},
+		Limits: &Limits{ClearEnv: true, EnvWhitelist: []string{"GTOOLS_KEEP"}},
+	}
+	result, err = app.Run(context.Background())
+	if err != nil || string(result.Stdout) != "12\n" {
+		t.Errorf("env = %q, %v", result.Stdout, err)
+	}
+}
+
+func TestAppService_StartPty(t *testing.T) {
+	app := AppService{Name: "sh", Args: []string{"-c", "stty size; [ -t 0 ] && echo tty; read line; echo got $line"}}
+	pty, err := app.StartPty(context.Background(), 24, 100)
+	if err != nil {
+		t.Fatalf("StartPty: %v", err)
+	}
+	defer pty.Close()
+	if _, err := pty.Write([]byte("hello\n")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	output, _ := io.ReadAll(pty)
+	for _, want := range []string{"24 100", "tty", "got hello"} {
+		if !strings.Contains(string(output), want) {
+			t.Errorf("output %q does not contain %q", output, want)
+		}
+	}
+	result, err := pty.Wait()
+	if err != nil || !result.Success() {
+		t.Errorf("Wait = %+v, %v", result, err)
+	}
+}
+
+func TestPipeline_Run(t *testing.T) {
+	step := func(name, script string, deps ...string) Step {
+		return Step{Name: name, Service: &AppService{Name: "sh", Args: []string{"-c", script}}, DependsOn: deps}
+	}
+	pipeline := Pipeline{
+		Steps: []Step{
+			step("version", `echo VERSION=1.2.3 >> "$GTOOLS_OUTPUT"`),
+			step("build", `echo "bin $VERSION" > "$GTOOLS_ARTIFACTS/app"`, "version"),
+			step("lint", "exit 1"),
+			step("package", `cat "$GTOOLS_ARTIFACTS/app"`, "build"),
+			step("publish", "true", "package", "lint"),
+		},
+		Concurrency:       2,
+		ContinueOnFailure: true,
+	}
+	report, err := pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	want := map[string]StepStatus{
+		"version": StepSucceeded,
+		"build":   StepSucceeded,
+		"lint":    StepFailed,
+		"package": StepSucceeded,
+		"publish": StepSkipped,
+	}
+	for name, status := range want {
+		if step, _ := report.Step(name); step.Status != status {
+			t.Errorf("%s = %v, want %v", name, step.Status, status)
+		}
+	}
+	if step, _ := report.Step("package"); string(step.Result.Stdout) != "bin 1.2.3\n" {
+		t.Errorf("package stdout = %q", step.Result.Stdout)
+	}
+
+	pipeline.ContinueOnFailure = false
+	pipeline.Steps[0] = step("version", "sleep 5")
+	report, err = pipeline.Run(context.Background())
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if step, _ := report.Step("version"); step.Status != StepCanceled {
+		t.Errorf("version = %v, want canceled", step.Status)
+	}
+	if step, _ := report.Step("build"); step.Status != StepSkipped {
+		t.Errorf("build = %v, want skipped", step.Status)
+	}
+
+	pipeline.Steps[0] = step("version", "true", "publish")
+	if _, err := pipeline.Run(context.Background()); err == nil {
+		t.Errorf("expected a cycle error")
+	}
+}
+
+// cancelSink cancels on its first line.
+type cancelSink struct{ cancel context.CancelFunc }
+
+func (s cancelSink) WriteLine(Line) error {
+	s.cancel()
+	return nil
+}
+
+func TestPipeline_RunCancelAfterExit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the unterminated line is flushed after the step exited, the cancel lands in between
+	pipeline := Pipeline{Steps: []Step{{
+		Name:    "done",
+		Service: &AppService{Name: "sh", Args: []string{"-c", "printf done"}, Sinks: []Sink{cancelSink{cancel}}},
+	}}}
+	report, _ := pipeline.Run(ctx)
+	if step, _ := report.Step("done"); step.Status != StepSucceeded || step.Err != nil {
+		t.Errorf("done = %v, %v, want succeeded", step.Status, step.Err)
+	}
+}
+
+func TestAppService_RunStdinScript(t *testing.T) {
+	app := AppService{Name: "cat", Stdin: strings.NewReader("from reader")}
+	if result, err := app.Run(context.Background()); err != nil || string(result.Stdout) != "from reader" {
+		t.Errorf("stdin = %q, %v", result.Stdout, err)
+	}
+
+	app = AppService{
+		Script:      "read name\necho \"$1 $name $GTOOLS_VAR\"\n",
+		Interpreter: InterpreterBash,
+		Args:        []string{"hello"},
+		Input:       "world\n",
+		Env:         []string{"GTOOLS_VAR=set"},
+	}
+	result, err := app.Run(context.Background())
+	if err != nil || string(result.Stdout) != "hello world set\n" {
+		t.Errorf("script = %q, %v", result.Stdout, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "gtools-script-*")); len(matches) > 0 {
+		t.Errorf("script files left behind: %v", matches)
+	}
+
+	t.Setenv("GTOOLS_PARENT", "parent")
+	app = AppService{Name: "sh", Args: []string{"-c", "echo $GTOOLS_PARENT-$GTOOLS_VAR"}, Env: []string{"GTOOLS_VAR=child"}}
+	if result, err := app.Run(context.Background()); err != nil || string(result.Stdout) != "parent-child\n" {
+		t.Errorf("merged env = %q, %v", result.Stdout, err)
+	}
+	app.ReplaceEnv = true
+	app.Name = "/bin/sh"
+	if result, err := app.Run(context.Background()); err != nil || string(result.Stdout) != "-child\n" {
+		t.Errorf("replaced env = %q, %v", result.Stdout, err)
+	}
+}
+
+func TestAppService_RunScriptCredential(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("switching users needs root")
+	}
+	app := AppService{
+		Home:   "/",
+		Script: "id -u\n",
+		Limits: &Limits{Credential: &syscall.Credential{Uid: 65534, Gid: 65534}},
+	}
+	result, err := app.Run(context.Background())
+	if err != nil || string(result.Stdout) != "65534\n" {
+		t.Errorf("script as 65534 = %q, %q, %v", result.Stdout, result.Stderr, err)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	recorder, err := NewRecorder(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewRecorder: %v", err)
+	}
+	app := AppService{Name: "sh", Args: []string{"-c", "echo one; sleep 0.5; echo two >&2; exit 2"}, Recorder: recorder}
+	go app.Run(context.Background())
+
+	var records []RunRecord
+	for deadline := time.Now().Add(time.Second * 2); len(records) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatalf("run was not recorded")
+		}
+		time.Sleep(time.Millisecond * 20)
+		records, _ = recorder.List(RunFilter{Name: "sh"})
+	}
+	lines, err := recorder.Tail(context.Background(), records[0].ID)
+	if err != nil {
+		t.Fatalf("Tail: %v", err)
+	}
+	var tailed []string
+	for line := range lines {
+		tailed = append(tailed, line.Stream+":"+line.Text)
+	}
+	if strings.Join(tailed, ",") != "stdout:one,stderr:two" {
+		t.Errorf("tail = %v", tailed)
+	}
+
+	record, err := recorder.Get(records[0].ID)
+	if err != nil || record.Running || record.ExitCode != 2 || record.EnvHash == "" {
+		t.Errorf("record = %+v, %v", record, err)
+	}
+	ring := NewRingSink(10)
+	if err := recorder.Replay(record.ID, ring); err != nil || len(ring.Lines()) != 2 {
+		t.Errorf("replay = %v, %v", ring.Lines(), err)
+	}
+	if records, _ := recorder.List(RunFilter{Name: "other"}); len(records) != 0 {
+		t.Errorf("filtered list = %v", records)
+	}
+}
@@ -0,0 +1,257 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var recordSeq atomic.Uint64
+
+// RunRecord is the metadata of one recorded run.
+type RunRecord struct {
+	ID       string    `json:"id"`
+	Name     string    `json:"name"`
+	Args     []string  `json:"args"`
+	Home     string    `json:"home"`
+	EnvHash  string    `json:"env_hash"`
+	Pid      int       `json:"pid"`
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	ExitCode int       `json:"exit_code"`
+	Signal   string    `json:"signal,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// RunFilter selects runs in Recorder.List, zero fields match everything.
+type RunFilter struct {
+	Name  string
+	Since time.Time
+	Limit int
+}
+
+// Recorder keeps every run of the AppServices using it in Dir, as <id>.json
+// for the metadata and <id>.jsonl for the interleaved output lines.
+type Recorder struct {
+	Dir string
+}
+
+func NewRecorder(dir string) (*Recorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Recorder{Dir: dir}, nil
+}
+
+// recording is the Sink that writes one run's output.
+type recording struct {
+	recorder *Recorder
+	record   RunRecord
+	mu       sync.Mutex
+	file     *os.File
+	encoder  *json.Encoder
+}
+
+func (r *Recorder) begin(name string, args []string, home string, env []string) (*recording, error) {
+	started := time.Now()
+	record := RunRecord{
+		ID:      fmt.Sprintf("%s-%d-%d", started.UTC().Format("20060102T150405.000000000"), os.Getpid(), recordSeq.Add(1)),
+		Name:    name,
+		Args:    args,
+		Home:    home,
+		EnvHash: envHash(env),
+		Running: true,
+		Started: started,
+	}
+	file, err := os.OpenFile(r.logPath(record.ID), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	rec := &recording{recorder: r, record: record, file: file, encoder: json.NewEncoder(file)}
+	if err := r.writeRecord(record); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return rec, nil
+}
+
+func (rec *recording) WriteLine(line Line) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return rec.encoder.Encode(line)
+}
+
+func (rec *recording) finish(result *Result, runErr error) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.record.Running = false
+	rec.record.Finished = time.Now()
+	if result != nil {
+		rec.record.Pid = result.Pid
+		rec.record.ExitCode = result.ExitCode
+		if result.Signal != 0 {
+			rec.record.Signal = result.Signal.String()
+		}
+	}
+	if runErr != nil {
+		rec.record.Error = runErr.Error()
+	}
+	closeErr := rec.file.Close()
+	if err := rec.recorder.writeRecord(rec.record); err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func (r *Recorder) metaPath(id string) string {
+	return filepath.Join(r.Dir, id+".json")
+}
+
+func (r *Recorder) logPath(id string) string {
+	return filepath.Join(r.Dir, id+".jsonl")
+}
+
+// writeRecord replaces the metadata file through a rename so readers never see it half written.
+func (r *Recorder) writeRecord(record RunRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	tmp := r.metaPath(record.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.metaPath(record.ID))
+}
+
+// Get returns the metadata of one run.
+func (r *Recorder) Get(id string) (RunRecord, error) {
+	var record RunRecord
+	data, err := os.ReadFile(r.metaPath(id))
+	if err != nil {
+		return record, err
+	}
+	err = json.Unmarshal(data, &record)
+	return record, err
+}
+
+// List returns the matching runs, newest first. A run whose process died with
+// the recorder stays marked as running.
+func (r *Recorder) List(filter RunFilter) ([]RunRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(r.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var records []RunRecord
+	for _, path := range paths {
+		record, err := r.Get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		if filter.Name != "" && record.Name != filter.Name {
+			continue
+		}
+		if !filter.Since.IsZero() && record.Started.Before(filter.Since) {
+			continue
+		}
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Started.After(records[j].Started)
+	})
+	if filter.Limit > 0 && len(records) > filter.Limit {
+		records = records[:filter.Limit]
+	}
+	return records, nil
+}
+
+// Replay sends the recorded output of a run to sink in its original order.
+func (r *Recorder) Replay(id string, sink Sink) error {
+	file, err := os.Open(r.logPath(id))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := json.NewDecoder(file)
+	for {
+		var line Line
+		if err := decoder.Decode(&line); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := sink.WriteLine(line); err != nil {
+			return err
+		}
+	}
+}
+
+// Tail sends the output recorded so far and then follows the log until the run
+// finishes or ctx is done. The channel is closed at the end.
+func (r *Recorder) Tail(ctx context.Context, id string) (<-chan Line, error) {
+	file, err := os.Open(r.logPath(id))
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Line, 64)
+	go func() {
+		defer close(ch)
+		defer file.Close()
+		reader := bufio.NewReader(file)
+		var partial []byte
+		for {
+			chunk, err := reader.ReadBytes('\n')
+			partial = append(partial, chunk...)
+			if err == nil {
+				var line Line
+				if json.Unmarshal(bytes.TrimSpace(partial), &line) == nil {
+					select {
+					case ch <- line:
+					case <-ctx.Done():
+						return
+					}
+				}
+				partial = partial[:0]
+				continue
+			}
+			if !errors.Is(err, io.EOF) {
+				return
+			}
+			// at the end of the log: stop once the run is over, its log is complete by then
+			record, err := r.Get(id)
+			if err != nil || !record.Running {
+				if _, err := reader.Peek(1); err != nil {
+					return
+				}
+				continue
+			}
+			select {
+			case <-time.After(time.Millisecond * 200):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func envHash(env []string) string {
+	sorted := append([]string(nil), env...)
+	sort.Strings(sorted)
+	sum := sha256.Sum256([]byte(strings.Join(sorted, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
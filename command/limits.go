@@ -0,0 +1,75 @@
+package command
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"time"
+)
+
+const (
+	LimitTimeout   = "timeout"
+	LimitCPU       = "cpu"
+	LimitMemory    = "memory"
+	LimitProcesses = "processes"
+)
+
+// ErrNoLimitShim is returned by Run when rlimits are set but main did not call LimitShim.
+var ErrNoLimitShim = errors.New("rlimits need command.LimitShim at the start of main")
+
+// Limits restricts a child process. Zero fields are not applied.
+type Limits struct {
+	// Timeout is the wall-clock limit, the process group is killed when it passes
+	Timeout time.Duration
+
+	// CPU, Memory (address space, bytes), OpenFiles and Processes are set as rlimits
+	// before the command is exec'd, by re-running the current binary, see LimitShim.
+	// Processes is RLIMIT_NPROC and therefore counts every process of the target uid.
+	//
+	// Not every limit is reported as a LimitError: OpenFiles never is, and Memory
+	// and Processes only with Cgroup. Without it the failing open, allocation or
+	// fork (EMFILE, ENOMEM, EAGAIN) is handled by the command itself and shows up
+	// as its exit status, with a nil error from Run.
+	CPU       time.Duration
+	Memory    uint64
+	OpenFiles uint64
+	Processes uint64
+
+	// Credential runs the process as another uid/gid
+	Credential *syscall.Credential
+
+	// ClearEnv drops the parent environment except the names in EnvWhitelist, AppService.Env is still applied
+	ClearEnv     bool
+	EnvWhitelist []string
+
+	// Cgroup is a cgroup v2 directory under which each run gets its own child group
+	// carrying Memory and Processes as memory.max and pids.max. It is skipped when
+	// cgroup v2 is not mounted.
+	Cgroup string
+}
+
+// LimitError is returned by Run when the process was stopped by its Timeout, its
+// CPU limit or the memory.max or pids.max of its cgroup.
+type LimitError struct {
+	Limit string
+	Value string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("command exceeded %s limit %s", e.Limit, e.Value)
+}
+
+// cpuExceeded reports whether the process went over its CPU rlimit: the soft
+// limit sends SIGXCPU and the hard limit, one second later, SIGKILL.
+func (l *Limits) cpuExceeded(result *Result) bool {
+	if l.CPU <= 0 || result == nil {
+		return false
+	}
+	switch result.Signal {
+	case syscall.SIGXCPU:
+		return true
+	case syscall.SIGKILL:
+		return result.UserTime+result.SystemTime >= l.CPU
+	}
+	return false
+}
@@ -0,0 +1,198 @@
+package command
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const rlimitNproc = 6
+
+// A child with rlimits is started as the current binary, whose main calls
+// LimitShim to apply them and exec the command found in rlimitPathEnv. The limits
+// are set before the first instruction of the command runs.
+const (
+	rlimitsEnv    = "GTOOLS_RLIMITS"
+	rlimitPathEnv = "GTOOLS_RLIMIT_PATH"
+)
+
+var (
+	cgroupSeq      atomic.Uint64
+	limitShimReady atomic.Bool
+)
+
+// LimitShim must be called first thing in main by programs that set the rlimits
+// of Limits. In a child started for them it applies the limits and execs the
+// command, it never returns there. In any other process it returns at once.
+// Package init functions still run in the child before main.
+func LimitShim() {
+	if spec, ok := os.LookupEnv(rlimitsEnv); ok {
+		err := execLimited(spec, os.Getenv(rlimitPathEnv))
+		fmt.Fprintf(os.Stderr, "gtools: %v\n", err)
+		os.Exit(126)
+	}
+	limitShimReady.Store(true)
+}
+
+type rlimit struct {
+	resource  int
+	soft, max uint64
+}
+
+func (l *Limits) rlimits() []rlimit {
+	var rlimits []rlimit
+	if l.CPU > 0 {
+		soft := uint64((l.CPU + time.Second - 1) / time.Second)
+		rlimits = append(rlimits, rlimit{syscall.RLIMIT_CPU, soft, soft + 1})
+	}
+	for _, item := range []rlimit{
+		{syscall.RLIMIT_AS, l.Memory, l.Memory},
+		{syscall.RLIMIT_NOFILE, l.OpenFiles, l.OpenFiles},
+		{rlimitNproc, l.Processes, l.Processes},
+	} {
+		if item.soft > 0 {
+			rlimits = append(rlimits, item)
+		}
+	}
+	return rlimits
+}
+
+// execLimited sets the rlimits encoded in spec and execs path, it only returns on failure.
+func execLimited(spec, path string) error {
+	for _, item := range strings.Split(spec, ",") {
+		var limit rlimit
+		if _, err := fmt.Sscanf(item, "%d=%d:%d", &limit.resource, &limit.soft, &limit.max); err != nil {
+			return fmt.Errorf("rlimit %q: %w", item, err)
+		}
+		if err := syscall.Setrlimit(limit.resource, &syscall.Rlimit{Cur: limit.soft, Max: limit.max}); err != nil {
+			return fmt.Errorf("setrlimit %d: %w", limit.resource, err)
+		}
+	}
+	env := make([]string, 0, len(os.Environ()))
+	for _, item := range os.Environ() {
+		if !strings.HasPrefix(item, rlimitsEnv+"=") && !strings.HasPrefix(item, rlimitPathEnv+"=") {
+			env = append(env, item)
+		}
+	}
+	return syscall.Exec(path, os.Args, env)
+}
+
+// wrap makes shell start through execLimited. A limit above the current hard
+// limit is refused here since the unprivileged child could not raise it.
+func (l *Limits) wrap(shell *exec.Cmd) error {
+	rlimits := l.rlimits()
+	if len(rlimits) == 0 || shell.Err != nil {
+		return nil
+	}
+	if !limitShimReady.Load() {
+		return ErrNoLimitShim
+	}
+	specs := make([]string, 0, len(rlimits))
+	for _, item := range rlimits {
+		var current syscall.Rlimit
+		if err := syscall.Getrlimit(item.resource, &current); err != nil {
+			return err
+		}
+		if item.max > current.Max {
+			return fmt.Errorf("rlimit %d: %d is above the hard limit %d", item.resource, item.max, current.Max)
+		}
+		specs = append(specs, fmt.Sprintf("%d=%d:%d", item.resource, item.soft, item.max))
+	}
+	shell.Env = append(shell.Env, rlimitsEnv+"="+strings.Join(specs, ","), rlimitPathEnv+"="+shell.Path)
+	shell.Path = "/proc/self/exe"
+	return nil
+}
+
+// limitGuard applies Limits to one run and inspects the outcome.
+type limitGuard struct {
+	limits *Limits
+	cgroup string
+	fd     *os.File
+}
+
+// prepare configures shell before it is started.
+func (l *Limits) prepare(shell *exec.Cmd) (*limitGuard, error) {
+	guard := &limitGuard{limits: l}
+	shell.SysProcAttr.Credential = l.Credential
+	if err := l.wrap(shell); err != nil {
+		return nil, err
+	}
+	if l.Cgroup == "" {
+		return guard, nil
+	}
+	if _, err := os.Stat("/sys/fs/cgroup/cgroup.controllers"); err != nil {
+		return guard, nil
+	}
+	dir := filepath.Join(l.Cgroup, fmt.Sprintf("gtools-%d-%d", os.Getpid(), cgroupSeq.Add(1)))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	guard.cgroup = dir
+	settings := map[string]uint64{"memory.max": l.Memory, "pids.max": l.Processes}
+	for name, value := range settings {
+		if value == 0 {
+			continue
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(strconv.FormatUint(value, 10)), 0o644); err != nil {
+			guard.release()
+			return nil, err
+		}
+	}
+	fd, err := os.Open(dir)
+	if err != nil {
+		guard.release()
+		return nil, err
+	}
+	guard.fd = fd
+	shell.SysProcAttr.UseCgroupFD = true
+	shell.SysProcAttr.CgroupFD = int(fd.Fd())
+	return guard, nil
+}
+
+// exceeded returns a LimitError when one of the limits ended the run.
+func (g *limitGuard) exceeded(result *Result) error {
+	l := g.limits
+	if g.cgroup != "" {
+		if cgroupEvent(filepath.Join(g.cgroup, "memory.events"), "oom_kill") > 0 {
+			return &LimitError{Limit: LimitMemory, Value: strconv.FormatUint(l.Memory, 10)}
+		}
+		if cgroupEvent(filepath.Join(g.cgroup, "pids.events"), "max") > 0 {
+			return &LimitError{Limit: LimitProcesses, Value: strconv.FormatUint(l.Processes, 10)}
+		}
+	}
+	if l.cpuExceeded(result) {
+		return &LimitError{Limit: LimitCPU, Value: l.CPU.String()}
+	}
+	return nil
+}
+
+// release closes and removes the per-run cgroup.
+func (g *limitGuard) release() {
+	if g.fd != nil {
+		g.fd.Close()
+	}
+	if g.cgroup != "" {
+		_ = os.Remove(g.cgroup)
+	}
+}
+
+func cgroupEvent(path, key string) uint64 {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		name, value, ok := strings.Cut(line, " ")
+		if ok && name == key {
+			n, _ := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package command
+
+import (
+	"errors"
+	"os/exec"
+)
+
+var errLimitsUnsupported = errors.New("rlimits and cgroups are only supported on linux")
+
+type limitGuard struct {
+	limits *Limits
+}
+
+// LimitShim does nothing, rlimits are not supported on this platform.
+func LimitShim() {}
+
+func (l *Limits) prepare(shell *exec.Cmd) (*limitGuard, error) {
+	if l.CPU > 0 || l.Memory > 0 || l.OpenFiles > 0 || l.Processes > 0 || l.Cgroup != "" {
+		return nil, errLimitsUnsupported
+	}
+	shell.SysProcAttr.Credential = l.Credential
+	return &limitGuard{limits: l}, nil
+}
+
+func (g *limitGuard) exceeded(result *Result) error {
+	return nil
+}
+
+func (g *limitGuard) release() {}
@@ -0,0 +1,339 @@
+package command
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// EnvArtifacts names the directory shared by every step of a pipeline run
+	EnvArtifacts = "GTOOLS_ARTIFACTS"
+	// EnvOutput names the file a step writes KEY=VALUE lines to, they are
+	// passed as environment variables to the steps that depend on it
+	EnvOutput = "GTOOLS_OUTPUT"
+)
+
+// Step is a named command in a pipeline. Every step needs its own AppService.
+type Step struct {
+	Name      string
+	Service   *AppService
+	DependsOn []string
+}
+
+type StepStatus int
+
+const (
+	StepPending StepStatus = iota
+	StepSucceeded
+	StepFailed
+	StepSkipped
+	StepCanceled
+)
+
+func (s StepStatus) String() string {
+	switch s {
+	case StepPending:
+		return "pending"
+	case StepSucceeded:
+		return "succeeded"
+	case StepFailed:
+		return "failed"
+	case StepSkipped:
+		return "skipped"
+	case StepCanceled:
+		return "canceled"
+	}
+	return "unknown"
+}
+
+type StepReport struct {
+	Name     string
+	Status   StepStatus
+	Started  time.Time
+	Finished time.Time
+	Duration time.Duration
+	Result   *Result
+	Err      error
+	Outputs  map[string]string
+}
+
+type PipelineReport struct {
+	Steps    []StepReport
+	Started  time.Time
+	Finished time.Time
+	Duration time.Duration
+}
+
+// Success reports whether every step succeeded.
+func (r *PipelineReport) Success() bool {
+	for _, step := range r.Steps {
+		if step.Status != StepSucceeded {
+			return false
+		}
+	}
+	return true
+}
+
+// Step returns the report of the named step.
+func (r *PipelineReport) Step(name string) (StepReport, bool) {
+	for _, step := range r.Steps {
+		if step.Name == name {
+			return step, true
+		}
+	}
+	return StepReport{}, false
+}
+
+// Pipeline runs a graph of steps, each step starts once all of its dependencies succeeded.
+type Pipeline struct {
+	Steps []Step
+
+	// Concurrency caps the number of steps running at once, 0 means no cap
+	Concurrency int
+
+	// ContinueOnFailure keeps running steps that do not depend on a failed one,
+	// otherwise the first failure cancels the running steps and skips the rest
+	ContinueOnFailure bool
+
+	// ArtifactDir is exported as GTOOLS_ARTIFACTS, empty uses a temporary directory removed after the run
+	ArtifactDir string
+}
+
+// Validate checks step names, dependencies and that the graph has no cycle.
+func (p *Pipeline) Validate() error {
+	index := map[string]int{}
+	for i, step := range p.Steps {
+		if step.Name == "" || step.Service == nil {
+			return fmt.Errorf("step %d: name and service are required", i)
+		}
+		if _, ok := index[step.Name]; ok {
+			return fmt.Errorf("step %s: duplicate name", step.Name)
+		}
+		index[step.Name] = i
+	}
+	pending := make([]int, len(p.Steps))
+	for i, step := range p.Steps {
+		for _, dep := range step.DependsOn {
+			if _, ok := index[dep]; !ok {
+				return fmt.Errorf("step %s: unknown dependency %s", step.Name, dep)
+			}
+		}
+		pending[i] = len(step.DependsOn)
+	}
+	// Kahn's algorithm, whatever is left unvisited sits on a cycle
+	var queue []int
+	for i := range p.Steps {
+		if pending[i] == 0 {
+			queue = append(queue, i)
+		}
+	}
+	dependents := p.dependents()
+	visited := 0
+	for len(queue) > 0 {
+		i := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, j := range dependents[i] {
+			if pending[j]--; pending[j] == 0 {
+				queue = append(queue, j)
+			}
+		}
+	}
+	if visited != len(p.Steps) {
+		var cycle []string
+		for i, step := range p.Steps {
+			if pending[i] > 0 {
+				cycle = append(cycle, step.Name)
+			}
+		}
+		return fmt.Errorf("dependency cycle between steps %s", strings.Join(cycle, ", "))
+	}
+	return nil
+}
+
+// dependents maps a step index to the indexes of the steps depending on it.
+func (p *Pipeline) dependents() map[int][]int {
+	index := map[string]int{}
+	for i, step := range p.Steps {
+		index[step.Name] = i
+	}
+	dependents := map[int][]int{}
+	for i, step := range p.Steps {
+		for _, dep := range step.DependsOn {
+			dependents[index[dep]] = append(dependents[index[dep]], i)
+		}
+	}
+	return dependents
+}
+
+type stepDone struct {
+	index  int
+	report StepReport
+}
+
+// Run executes the pipeline and returns a report with one entry per step in
+// definition order. Step failures are reported there; the error is non-nil
+// only for an invalid pipeline or a done ctx.
+func (p *Pipeline) Run(ctx context.Context) (*PipelineReport, error) {
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+	report := &PipelineReport{Started: time.Now(), Steps: make([]StepReport, len(p.Steps))}
+	for i, step := range p.Steps {
+		report.Steps[i] = StepReport{Name: step.Name, Status: StepPending}
+	}
+
+	artifacts := p.ArtifactDir
+	if artifacts == "" {
+		dir, err := os.MkdirTemp("", "gtools-artifacts-")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir)
+		artifacts = dir
+	} else if err := os.MkdirAll(artifacts, 0o755); err != nil {
+		return nil, err
+	}
+	outputs, err := os.MkdirTemp("", "gtools-outputs-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(outputs)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	index := map[string]int{}
+	pending := make([]int, len(p.Steps))
+	var ready []int
+	for i, step := range p.Steps {
+		index[step.Name] = i
+		pending[i] = len(step.DependsOn)
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	dependents := p.dependents()
+	limit := p.Concurrency
+	if limit <= 0 {
+		limit = len(p.Steps)
+	}
+
+	done := make(chan stepDone)
+	running := 0
+	failed := false
+	for {
+		for len(ready) > 0 && running < limit && runCtx.Err() == nil && (!failed || p.ContinueOnFailure) {
+			i := ready[0]
+			ready = ready[1:]
+			outputFile := filepath.Join(outputs, fmt.Sprintf("step-%d", i))
+			env := []string{EnvArtifacts + "=" + artifacts, EnvOutput + "=" + outputFile}
+			for _, dep := range p.Steps[i].DependsOn {
+				env = append(env, outputEnv(report.Steps[index[dep]].Outputs)...)
+			}
+			running++
+			go func(i int, env []string, outputFile string) {
+				done <- stepDone{index: i, report: p.runStep(runCtx, i, env, outputFile)}
+			}(i, env, outputFile)
+		}
+		if running == 0 {
+			break
+		}
+		finished := <-done
+		running--
+		report.Steps[finished.index] = finished.report
+		if finished.report.Status == StepSucceeded {
+			for _, j := range dependents[finished.index] {
+				if pending[j]--; pending[j] == 0 {
+					ready = append(ready, j)
+				}
+			}
+			continue
+		}
+		failed = true
+		if !p.ContinueOnFailure {
+			cancel()
+		}
+	}
+
+	for i := range report.Steps {
+		if report.Steps[i].Status == StepPending {
+			report.Steps[i].Status = StepSkipped
+		}
+	}
+	report.Finished = time.Now()
+	report.Duration = report.Finished.Sub(report.Started)
+	return report, ctx.Err()
+}
+
+func (p *Pipeline) runStep(ctx context.Context, i int, env []string, outputFile string) StepReport {
+	step := p.Steps[i]
+	report := StepReport{Name: step.Name, Started: time.Now()}
+	result, err := step.Service.run(ctx, step.Service.Sinks, env)
+	report.Finished = time.Now()
+	report.Duration = report.Finished.Sub(report.Started)
+	// a step that exited on its own just before the cancel keeps its own outcome
+	if errors.Is(err, context.Canceled) && result != nil && result.Signal == 0 {
+		err = nil
+	}
+	report.Result, report.Err = result, err
+	switch {
+	case err != nil && errors.Is(err, context.Canceled):
+		report.Status = StepCanceled
+	case err != nil || !result.Success():
+		report.Status = StepFailed
+	default:
+		report.Status = StepSucceeded
+		report.Outputs, report.Err = readOutputs(outputFile)
+		if report.Err != nil {
+			report.Status = StepFailed
+		}
+	}
+	return report
+}
+
+// readOutputs parses the KEY=VALUE lines a step wrote to its output file.
+func readOutputs(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	outputs := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid output line %q", line)
+		}
+		outputs[strings.TrimSpace(key)] = value
+	}
+	return outputs, scanner.Err()
+}
+
+func outputEnv(outputs map[string]string) []string {
+	keys := make([]string, 0, len(outputs))
+	for key := range outputs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	env := make([]string, 0, len(keys))
+	for _, key := range keys {
+		env = append(env, key+"="+outputs[key])
+	}
+	return env
+}
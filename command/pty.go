@@ -0,0 +1,155 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Pty is a command attached to a pseudo terminal. Read returns the terminal
+// output, stdout and stderr interleaved, and Write sends raw input.
+type Pty struct {
+	app     *AppService
+	shell   *exec.Cmd
+	master  *os.File
+	guard   *limitGuard
+	ctx     context.Context
+	runCtx  context.Context
+	cancel  context.CancelFunc
+	cleanup func()
+	done    chan struct{}
+
+	started time.Time
+	once    sync.Once
+	result  *Result
+	err     error
+}
+
+// StartPty starts the command in a new session with a pty of rows x cols as its
+// controlling terminal. c.Limits and c.Script apply as in Run; c.Stdin and
+// c.Input are ignored, input goes through Pty.Write.
+func (c *AppService) StartPty(ctx context.Context, rows, cols uint16) (*Pty, error) {
+	master, slave, err := openPty()
+	if err != nil {
+		return nil, err
+	}
+	defer slave.Close()
+	if err := setWinsize(master, rows, cols); err != nil {
+		master.Close()
+		return nil, err
+	}
+
+	runCtx, cancel := context.WithCancel(ctx)
+	if c.Limits != nil && c.Limits.Timeout > 0 {
+		cancel()
+		runCtx, cancel = context.WithTimeout(ctx, c.Limits.Timeout)
+	}
+	shell, cleanup, err := c.command(runCtx, nil)
+	if err != nil {
+		cancel()
+		master.Close()
+		return nil, err
+	}
+	// setsid also makes the child a process group leader, so Stop and cancel still reach the whole group
+	shell.SysProcAttr.Setpgid = false
+	shell.SysProcAttr.Setsid = true
+	shell.SysProcAttr.Setctty = true
+	shell.SysProcAttr.Ctty = 0
+	shell.Stdin, shell.Stdout, shell.Stderr = slave, slave, slave
+
+	p := &Pty{app: c, shell: shell, master: master, ctx: ctx, runCtx: runCtx, cancel: cancel, cleanup: cleanup}
+	if c.Limits != nil {
+		if p.guard, err = c.Limits.prepare(shell); err != nil {
+			cancel()
+			cleanup()
+			master.Close()
+			return nil, err
+		}
+	}
+	p.started = time.Now()
+	if err := c.start(shell); err != nil {
+		p.release()
+		master.Close()
+		return nil, err
+	}
+	c.mu.Lock()
+	p.done = c.done
+	c.mu.Unlock()
+	return p, nil
+}
+
+// Read reads terminal output, it returns io.EOF once the process side is closed.
+func (p *Pty) Read(b []byte) (int, error) {
+	n, err := p.master.Read(b)
+	// linux reports a hung up pty as EIO
+	if errors.Is(err, syscall.EIO) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// Write sends raw input, including control characters, to the terminal.
+func (p *Pty) Write(b []byte) (int, error) {
+	return p.master.Write(b)
+}
+
+// Resize changes the terminal window size and signals SIGWINCH to the process.
+func (p *Pty) Resize(rows, cols uint16) error {
+	return setWinsize(p.master, rows, cols)
+}
+
+// Pid returns the process id of the command.
+func (p *Pty) Pid() int {
+	return p.shell.Process.Pid
+}
+
+// Wait waits for the command to exit. The result carries no captured output,
+// which is only available through Read.
+func (p *Pty) Wait() (*Result, error) {
+	p.once.Do(func() {
+		waitErr := p.app.wait(p.shell)
+		result := &Result{Pid: p.shell.Process.Pid, Started: p.started, Finished: time.Now()}
+		result.Duration = result.Finished.Sub(result.Started)
+		fillState(result, p.shell.ProcessState)
+		p.result = result
+
+		var exitErr *exec.ExitError
+		switch {
+		case p.ctx.Err() != nil:
+			p.err = p.ctx.Err()
+		case p.runCtx.Err() != nil:
+			p.err = &LimitError{Limit: LimitTimeout, Value: p.app.Limits.Timeout.String()}
+		case waitErr != nil && !errors.As(waitErr, &exitErr):
+			p.err = waitErr
+		}
+		if p.err == nil && p.guard != nil {
+			p.err = p.guard.exceeded(result)
+		}
+		p.release()
+	})
+	return p.result, p.err
+}
+
+// Close kills the process group if it is still running and releases the terminal.
+func (p *Pty) Close() error {
+	select {
+	case <-p.done:
+	default:
+		syscall.Kill(-p.shell.Process.Pid, syscall.SIGKILL)
+	}
+	p.Wait()
+	return p.master.Close()
+}
+
+func (p *Pty) release() {
+	p.cancel()
+	p.cleanup()
+	if p.guard != nil {
+		p.guard.release()
+	}
+}
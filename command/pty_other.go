@@ -0,0 +1,18 @@
+//go:build !linux
+
+package command
+
+import (
+	"errors"
+	"os"
+)
+
+var errPtyUnsupported = errors.New("pty mode is only supported on linux")
+
+func openPty() (master, slave *os.File, err error) {
+	return nil, nil, errPtyUnsupported
+}
+
+func setWinsize(master *os.File, rows, cols uint16) error {
+	return errPtyUnsupported
+}
@@ -0,0 +1,221 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// DefaultMaxOutput is the per-stream capture cap used when AppService.MaxOutput is zero.
+const DefaultMaxOutput = 1 << 20
+
+// waitDelay bounds the wait for output after a cancel. A descendant that left the
+// process group, e.g. with setsid, survives the kill and may keep the pipes open.
+const waitDelay = time.Second * 3
+
+// Result describes a finished command.
+type Result struct {
+	Pid             int
+	ExitCode        int
+	Signal          syscall.Signal
+	Started         time.Time
+	Finished        time.Time
+	Duration        time.Duration
+	Stdout          []byte
+	Stderr          []byte
+	StdoutTruncated bool
+	StderrTruncated bool
+	UserTime        time.Duration
+	SystemTime      time.Duration
+	MaxRSS          int64 // kilobytes
+}
+
+// Success reports whether the command exited with status 0.
+func (r *Result) Success() bool {
+	return r != nil && r.ExitCode == 0 && r.Signal == 0
+}
+
+// capBuffer keeps the first max bytes written to it and drops the rest.
+type capBuffer struct {
+	buf       bytes.Buffer
+	max       int
+	truncated bool
+}
+
+func (b *capBuffer) Write(p []byte) (int, error) {
+	if b.max < 0 {
+		return b.buf.Write(p)
+	}
+	if room := b.max - b.buf.Len(); room < len(p) {
+		b.truncated = true
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+func (c *AppService) maxOutput() int {
+	if c.MaxOutput == 0 {
+		return DefaultMaxOutput
+	}
+	return c.MaxOutput
+}
+
+// command builds the exec.Cmd in its own process group; cancelling ctx kills the whole group.
+// extraEnv is appended to the environment after c.Env. cleanup removes the script file, if any.
+func (c *AppService) command(ctx context.Context, extraEnv []string) (shell *exec.Cmd, cleanup func(), err error) {
+	cleanup = func() {}
+	name, args := c.Name, c.Args
+	if c.Script != "" {
+		path, err := c.writeScript()
+		if err != nil {
+			return nil, nil, err
+		}
+		cleanup = func() { os.Remove(path) }
+		name, args = c.interpreter(), append([]string{path}, c.Args...)
+	}
+	shell = exec.CommandContext(ctx, name, args...)
+	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	shell.Dir = c.Home
+	shell.Env = c.environ(extraEnv)
+	shell.Cancel = func() error {
+		return syscall.Kill(-shell.Process.Pid, syscall.SIGKILL)
+	}
+	shell.WaitDelay = waitDelay
+	switch {
+	case c.Stdin != nil:
+		shell.Stdin = c.Stdin
+	case c.Input != "":
+		shell.Stdin = strings.NewReader(c.Input)
+	}
+	return shell, cleanup, nil
+}
+
+// environ returns os.Environ() overridden by c.Env and extra. ReplaceEnv drops
+// os.Environ() and Limits.ClearEnv keeps only its whitelisted names.
+func (c *AppService) environ(extra []string) []string {
+	env := []string{}
+	switch {
+	case c.Limits != nil && c.Limits.ClearEnv:
+		for _, item := range os.Environ() {
+			name, _, _ := strings.Cut(item, "=")
+			if slices.Contains(c.Limits.EnvWhitelist, name) {
+				env = append(env, item)
+			}
+		}
+	case !c.ReplaceEnv:
+		env = append(env, os.Environ()...)
+	}
+	return append(append(env, c.Env...), extra...)
+}
+
+// Run starts the command, waits for it and returns its result.
+// A non-zero exit is reported through Result, not as an error; the error is
+// non-nil only when the command could not be run, ctx was done first, or one of
+// c.Limits stopped it (*LimitError).
+// Output lines are also delivered to c.Sinks as they arrive.
+func (c *AppService) Run(ctx context.Context) (*Result, error) {
+	return c.run(ctx, c.Sinks, nil)
+}
+
+func (c *AppService) run(ctx context.Context, sinks []Sink, extraEnv []string) (result *Result, err error) {
+	runCtx := ctx
+	if c.Limits != nil && c.Limits.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, c.Limits.Timeout)
+		defer cancel()
+	}
+	shell, cleanup, err := c.command(runCtx, extraEnv)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+	if c.Recorder != nil {
+		name := c.Name
+		if name == "" {
+			name = shell.Args[0]
+		}
+		rec, err := c.Recorder.begin(name, c.Args, c.Home, shell.Env)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { rec.finish(result, err) }()
+		sinks = append(sinks[:len(sinks):len(sinks)], rec)
+	}
+	var guard *limitGuard
+	if c.Limits != nil {
+		if guard, err = c.Limits.prepare(shell); err != nil {
+			return nil, err
+		}
+		defer guard.release()
+	}
+
+	stdout := &capBuffer{max: c.maxOutput()}
+	stderr := &capBuffer{max: c.maxOutput()}
+	shell.Stdout = stdout
+	shell.Stderr = stderr
+	var lines []*lineWriter
+	if len(sinks) > 0 {
+		out := &fanout{sinks: sinks}
+		lines = []*lineWriter{{stream: StreamStdout, out: out}, {stream: StreamStderr, out: out}}
+		shell.Stdout = io.MultiWriter(stdout, lines[0])
+		shell.Stderr = io.MultiWriter(stderr, lines[1])
+	}
+
+	result = &Result{Started: time.Now()}
+	if err := c.start(shell); err != nil {
+		return nil, err
+	}
+	result.Pid = shell.Process.Pid
+
+	waitErr := c.wait(shell)
+	for _, line := range lines {
+		line.Flush()
+	}
+	result.Finished = time.Now()
+	result.Duration = result.Finished.Sub(result.Started)
+	result.Stdout, result.StdoutTruncated = stdout.buf.Bytes(), stdout.truncated
+	result.Stderr, result.StderrTruncated = stderr.buf.Bytes(), stderr.truncated
+	fillState(result, shell.ProcessState)
+
+	if ctx.Err() != nil {
+		return result, ctx.Err()
+	}
+	if runCtx.Err() != nil {
+		return result, &LimitError{Limit: LimitTimeout, Value: c.Limits.Timeout.String()}
+	}
+	if guard != nil {
+		if err := guard.exceeded(result); err != nil {
+			return result, err
+		}
+	}
+	var exitErr *exec.ExitError
+	if waitErr != nil && !errors.As(waitErr, &exitErr) {
+		return result, waitErr
+	}
+	return result, nil
+}
+
+func fillState(result *Result, state *os.ProcessState) {
+	if state == nil {
+		return
+	}
+	result.ExitCode = state.ExitCode()
+	result.UserTime = state.UserTime()
+	result.SystemTime = state.SystemTime()
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		result.Signal = status.Signal()
+	}
+	if usage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		result.MaxRSS = usage.Maxrss
+	}
+}
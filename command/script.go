@@ -0,0 +1,51 @@
+package command
+
+import (
+	"os"
+)
+
+const (
+	InterpreterSh     = "sh"
+	InterpreterBash   = "bash"
+	InterpreterPython = "python3"
+)
+
+var scriptExt = map[string]string{
+	InterpreterSh:     ".sh",
+	InterpreterBash:   ".sh",
+	InterpreterPython: ".py",
+}
+
+// writeScript writes c.Script to a private temp file, owned by the Limits.Credential
+// user when set, and returns its path.
+func (c *AppService) writeScript() (string, error) {
+	file, err := os.CreateTemp("", "gtools-script-*"+scriptExt[c.interpreter()])
+	if err != nil {
+		return "", err
+	}
+	// the interpreter runs as Limits.Credential and must be able to read it
+	if c.Limits != nil && c.Limits.Credential != nil {
+		if err := file.Chown(int(c.Limits.Credential.Uid), int(c.Limits.Credential.Gid)); err != nil {
+			file.Close()
+			os.Remove(file.Name())
+			return "", err
+		}
+	}
+	if _, err := file.WriteString(c.Script); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return "", err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (c *AppService) interpreter() string {
+	if c.Interpreter == "" {
+		return InterpreterSh
+	}
+	return c.Interpreter
+}
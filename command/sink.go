@@ -0,0 +1,250 @@
+package command
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// maxLineLength flushes an unterminated line once it grows past this size
+const maxLineLength = bufio.MaxScanTokenSize * 100
+
+// Line is one line of command output, Seq orders lines across both streams.
+type Line struct {
+	Stream string    `json:"stream"`
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Text   string    `json:"text"`
+}
+
+// Sink receives output lines. WriteLine is never called concurrently for one command.
+type Sink interface {
+	WriteLine(line Line) error
+}
+
+// fanout numbers lines and delivers them to every sink in order.
+type fanout struct {
+	mu    sync.Mutex
+	seq   uint64
+	sinks []Sink
+}
+
+func (f *fanout) emit(stream, text string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.seq++
+	line := Line{Stream: stream, Seq: f.seq, Time: time.Now(), Text: text}
+	for _, sink := range f.sinks {
+		_ = sink.WriteLine(line)
+	}
+}
+
+// lineWriter splits written bytes into lines for a fanout.
+type lineWriter struct {
+	stream  string
+	out     *fanout
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, p...)
+			if len(w.partial) >= maxLineLength {
+				w.Flush()
+			}
+			break
+		}
+		w.partial = append(w.partial, p[:i]...)
+		w.out.emit(w.stream, string(bytes.TrimSuffix(w.partial, []byte("\r"))))
+		w.partial = w.partial[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// Flush emits any trailing text that was not terminated by a newline.
+func (w *lineWriter) Flush() {
+	if len(w.partial) > 0 {
+		w.out.emit(w.stream, string(w.partial))
+		w.partial = w.partial[:0]
+	}
+}
+
+// WriterSink writes each line to W, prefixed with its stream name when Prefix is set.
+type WriterSink struct {
+	W      io.Writer
+	Prefix bool
+}
+
+func NewWriterSink(w io.Writer, prefix bool) *WriterSink {
+	return &WriterSink{W: w, Prefix: prefix}
+}
+
+func (s *WriterSink) WriteLine(line Line) error {
+	if s.Prefix {
+		_, err := fmt.Fprintf(s.W, "%s, %s\n", line.Stream, line.Text)
+		return err
+	}
+	_, err := fmt.Fprintln(s.W, line.Text)
+	return err
+}
+
+// ChanSink sends lines to C. When Block is false a full channel drops the line and counts it.
+type ChanSink struct {
+	C       chan<- Line
+	Block   bool
+	dropped atomic.Uint64
+}
+
+func NewChanSink(ch chan<- Line, block bool) *ChanSink {
+	return &ChanSink{C: ch, Block: block}
+}
+
+func (s *ChanSink) WriteLine(line Line) error {
+	if s.Block {
+		s.C <- line
+		return nil
+	}
+	select {
+	case s.C <- line:
+	default:
+		s.dropped.Add(1)
+	}
+	return nil
+}
+
+// Dropped returns the number of lines lost to a full channel.
+func (s *ChanSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// RingSink keeps the last Size lines in memory.
+type RingSink struct {
+	mu    sync.Mutex
+	size  int
+	lines []Line
+	next  int
+	full  bool
+}
+
+func NewRingSink(size int) *RingSink {
+	if size <= 0 {
+		size = 1
+	}
+	return &RingSink{size: size, lines: make([]Line, size)}
+}
+
+func (s *RingSink) WriteLine(line Line) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines[s.next] = line
+	s.next = (s.next + 1) % s.size
+	if s.next == 0 {
+		s.full = true
+	}
+	return nil
+}
+
+// Lines returns the buffered lines, oldest first.
+func (s *RingSink) Lines() []Line {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.full {
+		return append([]Line(nil), s.lines[:s.next]...)
+	}
+	return append(append([]Line(nil), s.lines[s.next:]...), s.lines[:s.next]...)
+}
+
+// RotateFileSink appends lines to Path and rotates it to Path.1 .. Path.MaxBackups
+// once it grows past MaxSize bytes.
+type RotateFileSink struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewRotateFileSink(path string, maxSize int64, maxBackups int) *RotateFileSink {
+	return &RotateFileSink{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+}
+
+func (s *RotateFileSink) WriteLine(line Line) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	text := fmt.Sprintf("%s %s %s\n", line.Time.Format(time.RFC3339Nano), line.Stream, line.Text)
+	if s.MaxSize > 0 && s.size > 0 && s.size+int64(len(text)) > s.MaxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.WriteString(text)
+	s.size += int64(n)
+	return err
+}
+
+func (s *RotateFileSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *RotateFileSink) rotate() error {
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	if s.MaxBackups <= 0 {
+		if err := os.Remove(s.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return s.open()
+	}
+	for i := s.MaxBackups; i > 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.Path, i-1), fmt.Sprintf("%s.%d", s.Path, i))
+	}
+	if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Close closes the current file, a later WriteLine reopens it.
+func (s *RotateFileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,100 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+var ErrNotStarted = errors.New("command not started")
+
+// StopStep tells which step of Stop ended the process.
+type StopStep int
+
+const (
+	StopNotRunning StopStep = iota // the process had already exited
+	StopBySignal                   // the process exited after StopSignal
+	StopByKill                     // the process was killed after the grace period
+)
+
+func (s StopStep) String() string {
+	switch s {
+	case StopNotRunning:
+		return "not running"
+	case StopBySignal:
+		return "signal"
+	case StopByKill:
+		return "kill"
+	}
+	return "unknown"
+}
+
+// start starts shell and publishes it so that Stop can reach the running process.
+func (c *AppService) start(shell *exec.Cmd) error {
+	c.mu.Lock()
+	c.Cmd = shell
+	if err := shell.Start(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.done = make(chan struct{})
+	c.mu.Unlock()
+	if c.onStart != nil {
+		c.onStart(shell.Process.Pid)
+	}
+	return nil
+}
+
+// wait waits for shell and wakes up any pending Stop.
+func (c *AppService) wait(shell *exec.Cmd) error {
+	err := shell.Wait()
+	c.mu.Lock()
+	close(c.done)
+	c.mu.Unlock()
+	return err
+}
+
+// Stop sends StopSignal (SIGTERM by default) to the process group and waits up to
+// grace for the process to exit, then kills the group with SIGKILL.
+// A done ctx skips the rest of the grace period.
+func (c *AppService) Stop(ctx context.Context, grace time.Duration) (StopStep, error) {
+	c.mu.Lock()
+	shell, done := c.Cmd, c.done
+	c.mu.Unlock()
+	if shell == nil || done == nil {
+		return StopNotRunning, ErrNotStarted
+	}
+	select {
+	case <-done:
+		return StopNotRunning, nil
+	default:
+	}
+
+	pid := shell.Process.Pid
+	sig := c.StopSignal
+	if sig == 0 {
+		sig = syscall.SIGTERM
+	}
+	if err := syscall.Kill(-pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return StopNotRunning, err
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	var ctxErr error
+	select {
+	case <-done:
+		return StopBySignal, nil
+	case <-timer.C:
+	case <-ctx.Done():
+		ctxErr = ctx.Err()
+	}
+
+	if err := syscall.Kill(-pid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return StopByKill, err
+	}
+	<-done
+	return StopByKill, ctxErr
+}
@@ -0,0 +1,338 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTooManyRestarts   = errors.New("too many restarts")
+	ErrSupervisorStopped = errors.New("supervisor stopped")
+)
+
+type RestartPolicy int
+
+const (
+	RestartNever RestartPolicy = iota
+	RestartOnFailure
+	RestartAlways
+)
+
+// State is the lifecycle state of a supervised child.
+type State int
+
+const (
+	StateStarting State = iota
+	StateRunning
+	StateBackoff
+	StateStopped
+	StateFailed
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStarting:
+		return "starting"
+	case StateRunning:
+		return "running"
+	case StateBackoff:
+		return "backoff"
+	case StateStopped:
+		return "stopped"
+	case StateFailed:
+		return "failed"
+	}
+	return "unknown"
+}
+
+// Backoff is an exponential restart delay, zero fields fall back to 1s, 1m and 2.
+type Backoff struct {
+	Initial    time.Duration
+	Max        time.Duration
+	Multiplier float64
+}
+
+func (b Backoff) withDefaults() Backoff {
+	if b.Initial <= 0 {
+		b.Initial = time.Second
+	}
+	if b.Max <= 0 {
+		b.Max = time.Minute
+	}
+	if b.Max < b.Initial {
+		b.Max = b.Initial
+	}
+	if b.Multiplier < 1 {
+		b.Multiplier = 2
+	}
+	return b
+}
+
+func (b Backoff) next(delay time.Duration) time.Duration {
+	delay = time.Duration(float64(delay) * b.Multiplier)
+	if delay > b.Max {
+		return b.Max
+	}
+	return delay
+}
+
+// ChildSpec describes one supervised command.
+type ChildSpec struct {
+	Name    string
+	Service *AppService
+	Restart RestartPolicy
+	Backoff Backoff
+
+	// MaxRestarts within Window before the child is marked failed, 0 means unlimited
+	MaxRestarts int
+	Window      time.Duration
+
+	// StopGrace is passed to AppService.Stop when the supervisor stops the child
+	StopGrace time.Duration
+}
+
+// Event is sent to Supervisor.OnEvent on every state change.
+type Event struct {
+	Child    string
+	State    State
+	Time     time.Time
+	Pid      int
+	Restarts int
+	Result   *Result
+	Err      error
+}
+
+// ChildStatus is a snapshot of a supervised child.
+type ChildStatus struct {
+	Name       string
+	State      State
+	Since      time.Time
+	Pid        int
+	Restarts   int
+	LastResult *Result
+	LastErr    error
+}
+
+type child struct {
+	spec   ChildSpec
+	status ChildStatus
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	exited chan struct{}
+	once   sync.Once
+}
+
+// Supervisor runs AppService children and restarts them according to their policy.
+type Supervisor struct {
+	OnEvent func(Event)
+
+	mu       sync.Mutex
+	ctx      context.Context
+	stopped  bool
+	children map[string]*child
+	order    []string
+}
+
+func NewSupervisor(onEvent func(Event)) *Supervisor {
+	return &Supervisor{OnEvent: onEvent, children: map[string]*child{}}
+}
+
+// Add registers a child, it is started right away when the supervisor is running.
+// A stopped supervisor refuses new children with ErrSupervisorStopped.
+func (s *Supervisor) Add(spec ChildSpec) error {
+	if spec.Name == "" || spec.Service == nil {
+		return errors.New("child name and service are required")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrSupervisorStopped
+	}
+	if s.children == nil {
+		s.children = map[string]*child{}
+	}
+	if _, ok := s.children[spec.Name]; ok {
+		return fmt.Errorf("child %s already exists", spec.Name)
+	}
+	spec.Backoff = spec.Backoff.withDefaults()
+	ch := &child{spec: spec, status: ChildStatus{Name: spec.Name, State: StateStopped, Since: time.Now()}}
+	s.children[spec.Name] = ch
+	s.order = append(s.order, spec.Name)
+	if s.ctx != nil {
+		s.launch(ch)
+	}
+	return nil
+}
+
+// Start launches every registered child. Cancelling ctx kills all children.
+func (s *Supervisor) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return ErrSupervisorStopped
+	}
+	if s.ctx != nil {
+		return errors.New("supervisor already started")
+	}
+	s.ctx = ctx
+	for _, name := range s.order {
+		s.launch(s.children[name])
+	}
+	return nil
+}
+
+// launch must be called with s.mu held.
+func (s *Supervisor) launch(ch *child) {
+	ch.ctx, ch.cancel = context.WithCancel(s.ctx)
+	ch.stop = make(chan struct{})
+	ch.exited = make(chan struct{})
+	go s.supervise(ch)
+}
+
+// Stop stops every child with its StopGrace and waits for them, a done ctx kills the rest.
+func (s *Supervisor) Stop(ctx context.Context) {
+	s.mu.Lock()
+	s.stopped = true
+	var running []*child
+	for _, name := range s.order {
+		if ch := s.children[name]; ch.exited != nil {
+			running = append(running, ch)
+		}
+	}
+	s.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, ch := range running {
+		wg.Add(1)
+		go func(ch *child) {
+			defer wg.Done()
+			ch.once.Do(func() { close(ch.stop) })
+			// between two runs Stop finds no process, a restart may be starting
+			// one right now and only the child context reaches it
+			if step, err := ch.spec.Service.Stop(ctx, ch.spec.StopGrace); err != nil || step == StopNotRunning {
+				ch.cancel()
+			}
+			select {
+			case <-ch.exited:
+			case <-ctx.Done():
+				ch.cancel()
+				<-ch.exited
+			}
+			ch.cancel()
+		}(ch)
+	}
+	wg.Wait()
+}
+
+// Status returns a snapshot of every child in the order they were added.
+func (s *Supervisor) Status() []ChildStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := make([]ChildStatus, 0, len(s.order))
+	for _, name := range s.order {
+		status = append(status, s.children[name].status)
+	}
+	return status
+}
+
+func (s *Supervisor) set(ch *child, state State, pid int, result *Result, err error) {
+	s.mu.Lock()
+	ch.status.State = state
+	ch.status.Since = time.Now()
+	ch.status.Pid = pid
+	if result != nil || err != nil {
+		ch.status.LastResult, ch.status.LastErr = result, err
+	}
+	event := Event{
+		Child:    ch.spec.Name,
+		State:    state,
+		Time:     ch.status.Since,
+		Pid:      pid,
+		Restarts: ch.status.Restarts,
+		Result:   result,
+		Err:      err,
+	}
+	s.mu.Unlock()
+	if s.OnEvent != nil {
+		s.OnEvent(event)
+	}
+}
+
+func (ch *child) stopping() bool {
+	select {
+	case <-ch.stop:
+		return true
+	default:
+		return ch.ctx.Err() != nil
+	}
+}
+
+func (s *Supervisor) supervise(ch *child) {
+	defer close(ch.exited)
+	defer ch.cancel()
+	spec := ch.spec
+	delay := spec.Backoff.Initial
+	var restarts []time.Time
+	for {
+		if ch.stopping() {
+			s.set(ch, StateStopped, 0, nil, nil)
+			return
+		}
+		s.set(ch, StateStarting, 0, nil, nil)
+		spec.Service.onStart = func(pid int) {
+			s.set(ch, StateRunning, pid, nil, nil)
+		}
+		result, err := spec.Service.Run(ch.ctx)
+		if ch.stopping() {
+			s.set(ch, StateStopped, 0, result, err)
+			return
+		}
+		failed := err != nil || !result.Success()
+		if spec.Restart == RestartNever || (spec.Restart == RestartOnFailure && !failed) {
+			if failed {
+				s.set(ch, StateFailed, 0, result, err)
+			} else {
+				s.set(ch, StateStopped, 0, result, err)
+			}
+			return
+		}
+
+		now := time.Now()
+		if spec.MaxRestarts > 0 {
+			recent := restarts[:0]
+			for _, at := range restarts {
+				if spec.Window <= 0 || now.Sub(at) < spec.Window {
+					recent = append(recent, at)
+				}
+			}
+			restarts = recent
+			if len(restarts) >= spec.MaxRestarts {
+				s.set(ch, StateFailed, 0, result, ErrTooManyRestarts)
+				return
+			}
+			restarts = append(restarts, now)
+		}
+		// a child that stayed up longer than the longest backoff starts over from Initial
+		if result != nil && result.Duration >= spec.Backoff.Max {
+			delay = spec.Backoff.Initial
+		}
+
+		s.mu.Lock()
+		ch.status.Restarts++
+		s.mu.Unlock()
+		s.set(ch, StateBackoff, 0, result, err)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ch.stop:
+			timer.Stop()
+		case <-ch.ctx.Done():
+			timer.Stop()
+		}
+		delay = spec.Backoff.next(delay)
+	}
+}
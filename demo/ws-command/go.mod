@@ -1,8 +1,9 @@
 module ws-command
 
-go 1.22.1
+go 1.23.1
 
 require (
+	github.com/Nname/gtools/command v0.0.0
 	github.com/gogf/gf/v2 v2.7.2
 	github.com/gorilla/websocket v1.5.3
 )
@@ -29,3 +30,5 @@ require (
 	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
+
+replace github.com/Nname/gtools/command => ../../command
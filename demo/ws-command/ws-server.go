@@ -3,16 +3,13 @@ package main
 import (
 	_ "net/http/pprof"
 
-	"bufio"
 	"context"
 	"fmt"
-	"io"
 	"net/http"
-	"os/exec"
 	"sync"
-	"syscall"
 	"time"
 
+	"github.com/Nname/gtools/command"
 	"github.com/gogf/gf/v2/encoding/gjson"
 	"github.com/gogf/gf/v2/frame/g"
 	"github.com/gogf/gf/v2/util/gconv"
@@ -36,10 +33,27 @@ type serverTaskReq struct {
 	Envs           []string `p:"envs" v:"required"`
 	Client         string   `p:"client"`
 	ClientProtocol string   `p:"client_protocol"`
+
+	// 资源限制, 0 不限制; timeout 与 cpu 单位秒, memory 单位字节
+	Timeout   int    `p:"timeout"`
+	CPU       int    `p:"cpu"`
+	Memory    uint64 `p:"memory"`
+	OpenFiles uint64 `p:"open_files"`
+	Processes uint64 `p:"processes"`
+}
+
+func (r serverTaskReq) limits() *command.Limits {
+	return &command.Limits{
+		Timeout:   time.Second * time.Duration(r.Timeout),
+		CPU:       time.Second * time.Duration(r.CPU),
+		Memory:    r.Memory,
+		OpenFiles: r.OpenFiles,
+		Processes: r.Processes,
+	}
 }
 
 type serverTaskExec struct {
-	cmd *exec.Cmd
+	app *command.AppService
 }
 
 type serverMessage struct {
@@ -47,128 +61,70 @@ type serverMessage struct {
 	msgData []byte
 }
 
-func serverTaskHandler(ch chan serverMessage, data serverTaskReq, chCmd chan serverTaskExec) {
+// wsSink 把输出行转发给 serverWrite, 通道满时丢弃
+type wsSink struct {
+	ch chan serverMessage
+}
+
+func (s wsSink) WriteLine(line command.Line) error {
 	select {
-	case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(gjson.New(data).String())}:
+	case s.ch <- serverMessage{websocket.TextMessage, gconv.Bytes(line.Text + "\n")}:
+		return nil
 	default:
-		fmt.Println("serverTaskHandler send err, ", "len: ", cap(ch))
-		return
+		return fmt.Errorf("ch send err, len: %d", cap(s.ch))
 	}
-	shellTask := AppService{Home: data.Home, Name: data.Name, Args: data.Args, Env: data.Envs}
-	go shellTask.StartCommandPipeCh(ch, chCmd)
 }
 
-type AppService struct {
-	Home string
-	Name string
-	Args []string
-	Env  []string
-	Cmd  *exec.Cmd
-}
-
-func (c *AppService) StartCommandPipeCh(ch chan serverMessage, chCmd chan serverTaskExec) {
-	shell := exec.Command(c.Name, c.Args...)
-	shell.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	shell.Dir = c.Home
-	shell.Env = c.Env
-	c.Cmd = shell
+func serverTaskHandler(ch chan serverMessage, data serverTaskReq, chCmd chan serverTaskExec) {
 	select {
-	case chCmd <- serverTaskExec{cmd: shell}:
+	case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(gjson.New(data).String())}:
 	default:
-		fmt.Println("chCmd send err, ", "len: ", cap(chCmd))
+		fmt.Println("serverTaskHandler send err, ", "len: ", cap(ch))
 		return
 	}
-
-	// stdout / stderr
-	pipeOut, pipeOutErr := c.Cmd.StdoutPipe()
-	if pipeOutErr != nil {
-		fmt.Println("pipeOutErr, ", pipeOutErr)
-		select {
-		case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(pipeOutErr)}:
-		default:
-			fmt.Println("pipeOutErr ch send err, ", "len: ", cap(ch))
-			return
-		}
-		return
+	shellTask := &command.AppService{
+		Home:       data.Home,
+		Name:       data.Name,
+		Args:       data.Args,
+		Env:        data.Envs,
+		ReplaceEnv: true,
+		Limits:     data.limits(),
+		Sinks:      []command.Sink{wsSink{ch}},
 	}
-	pipeErr, pipeErrErr := c.Cmd.StderrPipe()
-	if pipeErrErr != nil {
-		select {
-		case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(pipeErrErr)}:
-		default:
-			fmt.Println("pipeErrErr ch send err, ", "len: ", cap(ch))
-			return
-		}
-		fmt.Println("pipeErrErr, ", pipeErrErr)
+	select {
+	case chCmd <- serverTaskExec{app: shellTask}:
+	default:
+		fmt.Println("chCmd send err, ", "len: ", cap(chCmd))
 		return
 	}
+	go runTask(ch, shellTask)
+}
 
-	// start
-	startErr := shell.Start()
-	if startErr != nil {
-		fmt.Println("startErr, ", startErr)
-		select {
-		case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(startErr)}:
-		default:
-			fmt.Println("startErr ch send err, ", "len: ", cap(ch))
-			return
-		}
+// runTask 运行命令, 超出限制时把 LimitError 发给客户端
+func runTask(ch chan serverMessage, app *command.AppService) {
+	result, err := app.Run(context.Background())
+	var msg string
+	switch {
+	case err != nil:
+		fmt.Println("runErr, ", err)
+		msg = err.Error()
+	case !result.Success():
+		msg = fmt.Sprintf("exit status %d", result.ExitCode)
+	default:
 		return
 	}
-
-	// stdout
-	go func() {
-		reader := bufio.NewReader(pipeOut)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil || io.EOF == err {
-				break
-			}
-			fmt.Println("pipeOutReader, ", line)
-			select {
-			case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(line)}:
-			default:
-				fmt.Println("pipeOutReader ch send err, ", "len: ", cap(ch))
-				return
-			}
-		}
-	}()
-
-	// stderr
-	go func() {
-		reader := bufio.NewReader(pipeErr)
-		for {
-			line, err := reader.ReadString('\n')
-			if err != nil || io.EOF == err {
-				break
-			}
-			fmt.Println("pipeErrReader, ", line)
-			select {
-			case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(line)}:
-			default:
-				fmt.Println("pipeErrReader ch send err, ", "len: ", cap(ch))
-				return
-			}
-		}
-	}()
-
-	if waitErr := shell.Wait(); waitErr != nil {
-		fmt.Println("waitErr, ", waitErr)
-		select {
-		case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(waitErr)}:
-		default:
-			fmt.Println("waitErr ch send err, ", "len: ", cap(ch))
-			return
-		}
-		return
+	select {
+	case ch <- serverMessage{websocket.TextMessage, gconv.Bytes(msg)}:
+	default:
+		fmt.Println("runErr ch send err, ", "len: ", cap(ch))
 	}
 }
 
 func ExistPidGroup(ch chan serverMessage, chCmd chan serverTaskExec) {
 	close(chCmd)
 	for taskExec := range chCmd {
-		if taskExec.cmd != nil && taskExec.cmd.Process != nil {
-			syscall.Kill(-taskExec.cmd.Process.Pid, syscall.SIGKILL)
+		if taskExec.app != nil {
+			taskExec.app.StopCommand()
 		}
 	}
 	time.Sleep(time.Second * 3)
@@ -272,6 +228,9 @@ func serverTaskWebsocket(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// 带 rlimit 的命令经由本程序重新执行后再 exec
+	command.LimitShim()
+
 	//go clearStaleRequest()
 	server := &http.Server{
 		Addr: ":8080",
@@ -0,0 +1,131 @@
+package git
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// Auth configures how Clone and friends authenticate. The zero value uses
+// ~/.ssh/id_rsa (or ~/.ssh/id_ed25519) for ssh urls and no auth for http urls.
+type Auth struct {
+	// Key (PEM) or KeyPath is the ssh private key, Passphrase for encrypted keys
+	Key        []byte
+	KeyPath    string
+	Passphrase string
+
+	// Agent authenticates with the identities of the agent at SSH_AUTH_SOCK
+	Agent bool
+
+	// User is the ssh user, default git
+	User string
+
+	// KnownHostsPath verifies ssh host keys, default ~/.ssh/known_hosts or SSH_KNOWN_HOSTS.
+	// InsecureIgnoreHostKey skips the check.
+	KnownHostsPath        string
+	InsecureIgnoreHostKey bool
+
+	// Username and Password are http basic auth. Token is sent as the basic auth
+	// password, which GitHub, GitLab and Gitea accept for personal access tokens.
+	Username string
+	Password string
+	Token    string
+}
+
+// method returns the auth for url, nil for local and anonymous http repositories.
+func (a *Auth) method(url string) (transport.AuthMethod, error) {
+	if a == nil {
+		a = &Auth{}
+	}
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, err
+	}
+	switch endpoint.Protocol {
+	case "http", "https":
+		return a.httpMethod(), nil
+	case "ssh":
+		return a.sshMethod()
+	default:
+		return nil, nil
+	}
+}
+
+func (a *Auth) httpMethod() transport.AuthMethod {
+	switch {
+	case a.Token != "":
+		username := a.Username
+		if username == "" {
+			username = "git"
+		}
+		return &http.BasicAuth{Username: username, Password: a.Token}
+	case a.Username != "" || a.Password != "":
+		return &http.BasicAuth{Username: a.Username, Password: a.Password}
+	default:
+		return nil
+	}
+}
+
+func (a *Auth) sshMethod() (transport.AuthMethod, error) {
+	user := a.User
+	if user == "" {
+		user = "git"
+	}
+	var callback gossh.HostKeyCallback
+	switch {
+	case a.InsecureIgnoreHostKey:
+		callback = gossh.InsecureIgnoreHostKey() // not secure
+	case a.KnownHostsPath != "":
+		var err error
+		if callback, err = ssh.NewKnownHostsCallback(a.KnownHostsPath); err != nil {
+			return nil, err
+		}
+	}
+
+	if a.Agent {
+		auth, err := ssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, err
+		}
+		auth.HostKeyCallback = callback
+		return auth, nil
+	}
+	key := a.Key
+	if len(key) == 0 {
+		path := a.KeyPath
+		if path == "" {
+			path = defaultKeyPath()
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		key = data
+	}
+	auth, err := ssh.NewPublicKeys(user, key, a.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	auth.HostKeyCallback = callback
+	return auth, nil
+}
+
+// defaultKeyPath is ~/.ssh/id_rsa, or id_ed25519 when only that one exists.
+func defaultKeyPath() string {
+	dir := filepath.Join(os.Getenv("HOME"), ".ssh")
+	if os.Getenv("OS") == "Windows_NT" {
+		dir = filepath.Join(os.Getenv("HOMEDRIVE"), os.Getenv("HOMEPATH"), ".ssh")
+	}
+	path := filepath.Join(dir, "id_rsa")
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if _, err := os.Stat(filepath.Join(dir, "id_ed25519")); err == nil {
+			return filepath.Join(dir, "id_ed25519")
+		}
+	}
+	return path
+}
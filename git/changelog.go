@@ -0,0 +1,253 @@
+package git
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// FileStat is the diff stat of one file.
+type FileStat struct {
+	Name      string `json:"name"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+// ChangelogCommit is a commit parsed as a conventional commit, Type is "other"
+// when the subject does not follow the convention.
+type ChangelogCommit struct {
+	Hash     string     `json:"hash"`
+	Type     string     `json:"type"`
+	Scope    string     `json:"scope,omitempty"`
+	Breaking bool       `json:"breaking,omitempty"`
+	Subject  string     `json:"subject"`
+	Body     string     `json:"body,omitempty"`
+	Author   string     `json:"author"`
+	Email    string     `json:"email"`
+	Time     time.Time  `json:"time"`
+	Files    []FileStat `json:"files"`
+}
+
+// ChangelogGroup holds the commits of one type, newest first.
+type ChangelogGroup struct {
+	Type    string            `json:"type"`
+	Title   string            `json:"title"`
+	Commits []ChangelogCommit `json:"commits"`
+}
+
+// Changelog lists the commits reachable from To but not from From, like git log From..To.
+type Changelog struct {
+	From    string            `json:"from"`
+	To      string            `json:"to"`
+	Commits []ChangelogCommit `json:"commits"`
+	Groups  []ChangelogGroup  `json:"groups"`
+
+	// Files is the diff stat of the whole range
+	Files []FileStat `json:"files"`
+}
+
+// changelogTypes orders the groups, unknown types go to other.
+var changelogTypes = []struct{ Type, Title string }{
+	{"feat", "Features"},
+	{"fix", "Bug Fixes"},
+	{"perf", "Performance"},
+	{"refactor", "Refactoring"},
+	{"revert", "Reverts"},
+	{"docs", "Documentation"},
+	{"test", "Tests"},
+	{"build", "Build"},
+	{"ci", "CI"},
+	{"style", "Style"},
+	{"chore", "Chores"},
+	{"other", "Other Changes"},
+}
+
+var conventionalSubject = regexp.MustCompile(`^(\w+)(?:\(([^)]*)\))?(!)?:\s*(.+)$`)
+
+// NewChangelog walks the commits between the refs from and to, anything Resolve
+// accepts. An empty from starts at the root commit, or at the oldest fetched
+// commit of a shallow clone, which is listed without Files. Merge commits are skipped.
+func NewChangelog(repository *git.Repository, from, to string) (*Changelog, error) {
+	boundary, missing, err := shallowBoundary(repository)
+	if err != nil {
+		return nil, err
+	}
+	toRef, err := Resolve(repository, to)
+	if err != nil {
+		return nil, err
+	}
+	toCommit, err := repository.CommitObject(plumbing.NewHash(toRef.Hash))
+	if err != nil {
+		return nil, err
+	}
+	changelog := &Changelog{To: toRef.Hash}
+
+	seen := map[plumbing.Hash]bool{}
+	var fromTree *object.Tree
+	if from != "" {
+		fromRef, err := Resolve(repository, from)
+		if err != nil {
+			return nil, err
+		}
+		changelog.From = fromRef.Hash
+		fromCommit, err := repository.CommitObject(plumbing.NewHash(fromRef.Hash))
+		if err != nil {
+			return nil, err
+		}
+		if fromTree, err = fromCommit.Tree(); err != nil {
+			return nil, err
+		}
+		err = object.NewCommitPreorderIter(fromCommit, nil, missing).ForEach(func(commit *object.Commit) error {
+			seen[commit.Hash] = true
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = object.NewCommitPreorderIter(toCommit, seen, missing).ForEach(func(commit *object.Commit) error {
+		if commit.NumParents() > 1 {
+			return nil
+		}
+		entry, err := changelogCommit(commit, boundary[commit.Hash])
+		if err != nil {
+			return err
+		}
+		changelog.Commits = append(changelog.Commits, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	changelog.Groups = groupCommits(changelog.Commits)
+
+	toTree, err := toCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := changes.Patch()
+	if err != nil {
+		return nil, err
+	}
+	changelog.Files = fileStats(patch.Stats())
+	return changelog, nil
+}
+
+// shallowBoundary returns the oldest commits of a shallow clone and their
+// parents, which are not in the repository. Walks ignoring those parents stop at
+// the boundary instead of failing with object not found.
+func shallowBoundary(repository *git.Repository) (map[plumbing.Hash]bool, []plumbing.Hash, error) {
+	shallow, err := repository.Storer.Shallow()
+	if err != nil {
+		return nil, nil, err
+	}
+	boundary := map[plumbing.Hash]bool{}
+	var missing []plumbing.Hash
+	for _, hash := range shallow {
+		commit, err := repository.CommitObject(hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		boundary[hash] = true
+		missing = append(missing, commit.ParentHashes...)
+	}
+	return boundary, missing, nil
+}
+
+// changelogCommit parses commit, a shallow boundary commit has no parent to
+// diff against and gets no Files.
+func changelogCommit(commit *object.Commit, shallow bool) (ChangelogCommit, error) {
+	var stats object.FileStats
+	if !shallow {
+		var err error
+		if stats, err = commit.Stats(); err != nil {
+			return ChangelogCommit{}, err
+		}
+	}
+	message := strings.TrimSpace(commit.Message)
+	subject, body, _ := strings.Cut(message, "\n")
+	entry := ChangelogCommit{
+		Hash:    commit.Hash.String(),
+		Type:    "other",
+		Subject: strings.TrimSpace(subject),
+		Body:    strings.TrimSpace(body),
+		Author:  commit.Author.Name,
+		Email:   commit.Author.Email,
+		Time:    commit.Author.When,
+		Files:   fileStats(stats),
+	}
+	if match := conventionalSubject.FindStringSubmatch(entry.Subject); match != nil {
+		entry.Type = strings.ToLower(match[1])
+		entry.Scope = match[2]
+		entry.Breaking = match[3] == "!"
+		entry.Subject = match[4]
+	}
+	if strings.Contains(entry.Body, "BREAKING CHANGE:") || strings.Contains(entry.Body, "BREAKING-CHANGE:") {
+		entry.Breaking = true
+	}
+	return entry, nil
+}
+
+func groupCommits(commits []ChangelogCommit) []ChangelogGroup {
+	known := map[string]bool{}
+	for _, t := range changelogTypes {
+		known[t.Type] = true
+	}
+	var groups []ChangelogGroup
+	for _, t := range changelogTypes {
+		group := ChangelogGroup{Type: t.Type, Title: t.Title}
+		for _, commit := range commits {
+			if commit.Type == t.Type || (t.Type == "other" && !known[commit.Type]) {
+				group.Commits = append(group.Commits, commit)
+			}
+		}
+		if len(group.Commits) > 0 {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+func fileStats(stats object.FileStats) []FileStat {
+	files := make([]FileStat, 0, len(stats))
+	for _, stat := range stats {
+		files = append(files, FileStat{Name: stat.Name, Additions: stat.Addition, Deletions: stat.Deletion})
+	}
+	return files
+}
+
+// Markdown renders the groups and the file stat, usable as lark_md in a Feishu card or in a mail.
+func (c *Changelog) Markdown() string {
+	var b strings.Builder
+	for _, group := range c.Groups {
+		fmt.Fprintf(&b, "**%s**\n", group.Title)
+		for _, commit := range group.Commits {
+			line := commit.Subject
+			if commit.Scope != "" {
+				line = fmt.Sprintf("%s: %s", commit.Scope, line)
+			}
+			if commit.Breaking {
+				line = "BREAKING " + line
+			}
+			fmt.Fprintf(&b, "- %s (%s, %s)\n", line, commit.Hash[:7], commit.Author)
+		}
+		b.WriteString("\n")
+	}
+	additions, deletions := 0, 0
+	for _, file := range c.Files {
+		additions += file.Additions
+		deletions += file.Deletions
+	}
+	fmt.Fprintf(&b, "%d files changed, +%d -%d\n", len(c.Files), additions, deletions)
+	return b.String()
+}
@@ -0,0 +1,145 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"path"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// Checkout is an existing working copy, see Open.
+type Checkout struct {
+	Dir        string
+	Repository *git.Repository
+	Auth       *Auth
+
+	// Author signs Commit and Tag
+	Author *Author
+}
+
+// Open opens the working copy at dir, auth is used to fetch from origin.
+func Open(dir string, auth *Auth) (*Checkout, error) {
+	repository, err := git.PlainOpen(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &Checkout{Dir: dir, Repository: repository, Auth: auth}, nil
+}
+
+// URL is the first url of origin.
+func (c *Checkout) URL() (string, error) {
+	remote, err := c.Repository.Remote(git.DefaultRemoteName)
+	if err != nil {
+		return "", err
+	}
+	return remote.Config().URLs[0], nil
+}
+
+// Fetch updates the branches and tags of origin.
+func (c *Checkout) Fetch(progress sideband.Progress) error {
+	url, err := c.URL()
+	if err != nil {
+		return err
+	}
+	method, err := c.Auth.method(url)
+	if err != nil {
+		return err
+	}
+	err = c.Repository.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		Auth:       method,
+		Tags:       git.AllTags,
+		Force:      true,
+		Progress:   progress,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil
+	}
+	return err
+}
+
+// Update fetches origin and resets the working copy to ref, see Reset.
+func (c *Checkout) Update(ref string, progress sideband.Progress) (string, error) {
+	if err := c.Fetch(progress); err != nil {
+		return "", err
+	}
+	return c.Reset(ref)
+}
+
+// Reset checks out ref as found by Resolve, dropping local changes and
+// untracked files like git reset --hard && git clean -fd. A branch is checked
+// out as the local branch moved to origin, tags and commits detached.
+// It returns the commit hash.
+func (c *Checkout) Reset(ref string) (string, error) {
+	resolved, err := Resolve(c.Repository, ref)
+	if err != nil {
+		return "", err
+	}
+	hash := plumbing.NewHash(resolved.Hash)
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	options := &git.CheckoutOptions{Hash: hash, Force: true}
+	if resolved.Kind == RefBranch {
+		name := plumbing.NewBranchReferenceName(ref)
+		if err := c.Repository.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+			return "", err
+		}
+		options = &git.CheckoutOptions{Branch: name, Force: true}
+	}
+	if err := worktree.Checkout(options); err != nil {
+		return "", err
+	}
+	if err := worktree.Clean(&git.CleanOptions{Dir: true}); err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// UpdateSubmodules initialises and checks out the submodules recursively up to
+// levels deep, shallow fetches only their recorded commit. Each submodule
+// authenticates with Auth for its own url.
+func (c *Checkout) UpdateSubmodules(levels int, shallow bool) error {
+	if levels <= 0 {
+		return nil
+	}
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return err
+	}
+	submodules, err := worktree.Submodules()
+	if err != nil {
+		return err
+	}
+	parent, err := c.URL()
+	if err != nil {
+		return err
+	}
+	for _, submodule := range submodules {
+		url := submodule.Config().URL
+		if endpoint, err := transport.NewEndpoint(url); err == nil && endpoint.Protocol == "file" && !path.IsAbs(endpoint.Path) {
+			url = parent // relative to origin, same host and credentials
+		}
+		method, err := c.Auth.method(url)
+		if err != nil {
+			return err
+		}
+		options := &git.SubmoduleUpdateOptions{
+			Init:              true,
+			Auth:              method,
+			RecurseSubmodules: git.SubmoduleRescursivity(levels - 1),
+		}
+		if shallow {
+			options.Depth = 1
+		}
+		if err := submodule.Update(options); err != nil {
+			return fmt.Errorf("submodule %s: %w", submodule.Config().Name, err)
+		}
+	}
+	return nil
+}
@@ -1,30 +1,34 @@
 package git
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
-	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
-	"os"
-	"path/filepath"
 )
 
 func Clone(dir, url, branch string, Depth int, progress sideband.Progress) (string, error) {
-	path := filepath.Join(os.Getenv("HOME"), ".ssh", "id_rsa")
-	if os.Getenv("OS") == "Windows_NT" {
-		path = filepath.Join(os.Getenv("HOMEDRIVE"), os.Getenv("HOMEPATH"), ".ssh", "id_rsa")
-	}
-	data, err := os.ReadFile(path)
+	return CloneWithAuth(dir, url, branch, Depth, progress, nil)
+}
+
+// CloneWithAuth is Clone with explicit credentials, a nil auth behaves like Clone.
+func CloneWithAuth(dir, url, branch string, depth int, progress sideband.Progress, auth *Auth) (string, error) {
+	method, err := auth.method(url)
 	if err != nil {
 		return "", err
 	}
-	var key *ssh.PublicKeys
-	key, _ = ssh.NewPublicKeys("git", data, "")
 	repository, err := git.PlainClone(dir, false, &git.CloneOptions{
 		URL:           url,
-		Auth:          key,
+		Auth:          method,
 		ReferenceName: plumbing.NewBranchReferenceName(branch),
-		Depth:         Depth,
+		Depth:         depth,
 		Progress:      progress,
 	})
 	if err != nil {
@@ -40,3 +44,209 @@ func Clone(dir, url, branch string, Depth int, progress sideband.Progress) (stri
 	}
 	return commit.Hash.String(), nil
 }
+
+// CloneOptions for CloneRef.
+type CloneOptions struct {
+	URL string
+
+	// Ref is a branch, tag or commit hash of URL, default the remote HEAD.
+	// Depth is ignored for commits since they may be anywhere in the history.
+	Ref   string
+	Depth int
+
+	// Submodules initialises submodules recursively up to this many levels, 0 skips
+	// them. ShallowSubmodules fetches only their recorded commit.
+	Submodules        int
+	ShallowSubmodules bool
+
+	// SparsePaths checks out only these directories, it cannot be combined with Submodules
+	SparsePaths []string
+
+	Progress sideband.Progress
+	Auth     *Auth
+}
+
+var ErrSparseSubmodules = errors.New("sparse checkout cannot be combined with submodules")
+
+// CloneResult describes the commit checked out by CloneRef.
+type CloneResult struct {
+	Ref     Ref
+	Hash    string
+	Author  string
+	Email   string
+	Message string
+	Time    time.Time
+
+	// Tags point at the commit, Version is git describe --tags --always
+	Tags    []string
+	Version string
+
+	Repository *git.Repository
+}
+
+// CloneRef clones options.URL into dir and checks out options.Ref.
+func CloneRef(dir string, options CloneOptions) (*CloneResult, error) {
+	if len(options.SparsePaths) > 0 && options.Submodules > 0 {
+		return nil, ErrSparseSubmodules
+	}
+	method, err := options.Auth.method(options.URL)
+	if err != nil {
+		return nil, err
+	}
+	clone := &git.CloneOptions{
+		URL:      options.URL,
+		Auth:     method,
+		Depth:    options.Depth,
+		Progress: options.Progress,
+		Tags:     git.AllTags,
+	}
+	kind := RefBranch
+	if options.Ref != "" {
+		if kind, err = remoteKind(options.URL, options.Ref, options.Auth); err != nil {
+			return nil, err
+		}
+		switch kind {
+		case RefBranch:
+			clone.ReferenceName = plumbing.NewBranchReferenceName(options.Ref)
+		case RefTag:
+			clone.ReferenceName = plumbing.NewTagReferenceName(options.Ref)
+		case RefCommit:
+			clone.Depth = 0
+			clone.NoCheckout = true
+		}
+	}
+	if len(options.SparsePaths) > 0 {
+		clone.NoCheckout = true
+	}
+	repository, err := git.PlainClone(dir, false, clone)
+	if err != nil {
+		return nil, err
+	}
+	if clone.NoCheckout {
+		checkout := &git.CheckoutOptions{Force: true, SparseCheckoutDirectories: options.SparsePaths}
+		if kind == RefCommit {
+			hash, err := repository.ResolveRevision(plumbing.Revision(options.Ref))
+			if err != nil {
+				return nil, fmt.Errorf("resolve %s: %w", options.Ref, err)
+			}
+			checkout.Hash = *hash
+		} else {
+			head, err := repository.Head()
+			if err != nil {
+				return nil, err
+			}
+			if head.Name().IsBranch() {
+				checkout.Branch = head.Name()
+			} else {
+				checkout.Hash = head.Hash()
+			}
+		}
+		worktree, err := repository.Worktree()
+		if err != nil {
+			return nil, err
+		}
+		if len(options.SparsePaths) > 0 {
+			// go-git only skips paths already in the index, fill it first
+			commit := checkout.Hash
+			if commit.IsZero() {
+				head, err := repository.Head()
+				if err != nil {
+					return nil, err
+				}
+				commit = head.Hash()
+			}
+			if err := worktree.Reset(&git.ResetOptions{Commit: commit, Mode: git.MixedReset}); err != nil {
+				return nil, err
+			}
+		}
+		if err := worktree.Checkout(checkout); err != nil {
+			return nil, err
+		}
+		if err := pruneSparse(dir, repository, options.SparsePaths); err != nil {
+			return nil, err
+		}
+	}
+	if options.Submodules > 0 {
+		checkout := &Checkout{Dir: dir, Repository: repository, Auth: options.Auth}
+		if err := checkout.UpdateSubmodules(options.Submodules, options.ShallowSubmodules); err != nil {
+			return nil, err
+		}
+	}
+	result, err := headResult(repository)
+	if err != nil {
+		return nil, err
+	}
+	if options.Ref != "" {
+		result.Ref = Ref{Name: options.Ref, Kind: kind, Hash: result.Hash}
+	}
+	return result, nil
+}
+
+// pruneSparse marks the index entries outside paths as skip-worktree and removes
+// their files. go-git checks out files sharing a parent directory with paths
+// and drops the flag from their entries.
+func pruneSparse(dir string, repository *git.Repository, paths []string) error {
+	index, err := repository.Storer.Index()
+	if err != nil {
+		return err
+	}
+	for _, entry := range index.Entries {
+		entry.SkipWorktree = !slices.ContainsFunc(paths, func(path string) bool {
+			path = strings.Trim(path, "/")
+			return entry.Name == path || strings.HasPrefix(entry.Name, path+"/")
+		})
+		if !entry.SkipWorktree {
+			continue
+		}
+		file := filepath.Join(dir, filepath.FromSlash(entry.Name))
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		// drop the directories left empty, stops at the first one that is not
+		for parent := filepath.Dir(file); parent != dir && os.Remove(parent) == nil; parent = filepath.Dir(parent) {
+		}
+	}
+	return repository.Storer.SetIndex(index)
+}
+
+// Head describes the commit checked out in c.
+func (c *Checkout) Head() (*CloneResult, error) {
+	return headResult(c.Repository)
+}
+
+func headResult(repository *git.Repository) (*CloneResult, error) {
+	head, err := repository.Head()
+	if err != nil {
+		return nil, err
+	}
+	commit, err := repository.CommitObject(head.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tags, err := tagsByCommit(repository)
+	if err != nil {
+		return nil, err
+	}
+	version, err := describe(repository, commit.Hash, tags)
+	if err != nil {
+		return nil, err
+	}
+	ref := Ref{Name: commit.Hash.String(), Kind: RefCommit, Hash: commit.Hash.String()}
+	switch {
+	case head.Name().IsBranch():
+		ref = Ref{Name: head.Name().Short(), Kind: RefBranch, Hash: commit.Hash.String()}
+	case len(tags[commit.Hash]) > 0:
+		ref = Ref{Name: tags[commit.Hash][0], Kind: RefTag, Hash: commit.Hash.String()}
+	}
+	return &CloneResult{
+		Ref:        ref,
+		Hash:       commit.Hash.String(),
+		Author:     commit.Author.Name,
+		Email:      commit.Author.Email,
+		Message:    commit.Message,
+		Time:       commit.Author.When,
+		Tags:       tags[commit.Hash],
+		Version:    version,
+		Repository: repository,
+	}, nil
+}
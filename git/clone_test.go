@@ -1,9 +1,407 @@
 package git
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	gossh "golang.org/x/crypto/ssh"
 )
 
+var testSignature = object.Signature{Name: "gtools", Email: "gtools@example.com", When: time.Unix(1700000000, 0)}
+
+// newTestRepo creates a repository on master with one commit per message.
+func newTestRepo(t *testing.T, messages ...string) (string, *git.Repository) {
+	t.Helper()
+	dir := t.TempDir()
+	repository, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, message := range messages {
+		commitFile(t, repository, "README.md", message)
+	}
+	return dir, repository
+}
+
+// commitFile writes content to name and commits it with content as message.
+func commitFile(t *testing.T, repository *git.Repository, name, content string) string {
+	t.Helper()
+	worktree, err := repository.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(worktree.Filesystem.Root(), name)
+	os.MkdirAll(filepath.Dir(path), 0o755)
+	if err := os.WriteFile(path, []byte(content+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Add(name); err != nil {
+		t.Fatal(err)
+	}
+	signature := testSignature
+	signature.When = signature.When.Add(time.Minute * time.Duration(len(content)))
+	hash, err := worktree.Commit(content, &git.CommitOptions{Author: &signature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash.String()
+}
+
 func TestClone(t *testing.T) {
-	//
+	origin, repository := newTestRepo(t, "init", "second")
+	head, _ := repository.Head()
+	t.Setenv("HOME", t.TempDir()) // a local clone must not need ~/.ssh/id_rsa
+
+	hash, err := Clone(filepath.Join(t.TempDir(), "clone"), origin, "master", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != head.Hash().String() {
+		t.Errorf("hash = %s, want %s", hash, head.Hash())
+	}
+}
+
+func TestAuth_method(t *testing.T) {
+	method, err := (&Auth{Token: "ghp_x"}).method("https://github.com/Nname/gtools.git")
+	if basic, ok := method.(*http.BasicAuth); err != nil || !ok || basic.Username != "git" || basic.Password != "ghp_x" {
+		t.Errorf("token = %#v, %v", method, err)
+	}
+	if method, err := (*Auth)(nil).method("https://github.com/Nname/gtools.git"); err != nil || method != nil {
+		t.Errorf("anonymous = %#v, %v", method, err)
+	}
+
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := gossh.MarshalPrivateKeyWithPassphrase(private, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := &Auth{Key: pem.EncodeToMemory(block), Passphrase: "secret", User: "deploy", InsecureIgnoreHostKey: true}
+	method, err = auth.method("git@github.com:Nname/gtools.git")
+	if keys, ok := method.(*ssh.PublicKeys); err != nil || !ok || keys.User != "deploy" || keys.HostKeyCallback == nil {
+		t.Errorf("ed25519 = %#v, %v", method, err)
+	}
+	auth.Passphrase = "wrong"
+	if _, err := auth.method("ssh://git@github.com/Nname/gtools.git"); err == nil {
+		t.Error("expected an error for a wrong passphrase")
+	}
+	if _, err := (&Auth{KeyPath: filepath.Join(t.TempDir(), "missing")}).method("git@github.com:Nname/gtools.git"); err == nil {
+		t.Error("expected an error for a missing key")
+	}
+}
+
+func TestCheckout_Update(t *testing.T) {
+	origin, repository := newTestRepo(t, "init")
+	dir := filepath.Join(t.TempDir(), "clone")
+	first, err := Clone(dir, origin, "master", 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := commitFile(t, repository, "main.go", "package main")
+	repository.CreateTag("v1.0.0", plumbing.NewHash(second), &git.CreateTagOptions{Tagger: &testSignature, Message: "v1.0.0"})
+	third := commitFile(t, repository, "main.go", "package main // fix")
+
+	checkout, err := Open(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "build.log"), []byte("stale"), 0o644)
+	for _, tc := range []struct{ ref, want string }{
+		{"master", third},
+		{"v1.0.0", second},
+		{first[:8], first},
+	} {
+		hash, err := checkout.Update(tc.ref, nil)
+		if err != nil || hash != tc.want {
+			t.Errorf("Update(%s) = %s, %v, want %s", tc.ref, hash, err, tc.want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "build.log")); !os.IsNotExist(err) {
+		t.Errorf("untracked file kept: %v", err)
+	}
+	if _, err := checkout.Reset("missing"); err == nil {
+		t.Error("expected an error for an unknown ref")
+	}
+}
+
+func TestMirror_Clone(t *testing.T) {
+	origin, repository := newTestRepo(t, "init")
+	mirror := NewMirror(t.TempDir(), nil)
+	checkout, hash, err := mirror.Clone(filepath.Join(t.TempDir(), "a"), origin, "master", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url, _ := checkout.URL(); url != origin {
+		t.Errorf("origin = %s, want %s", url, origin)
+	}
+	if _, err := os.Stat(mirror.Path(origin)); err != nil {
+		t.Fatal(err)
+	}
+
+	next := commitFile(t, repository, "main.go", "package main")
+	_, hash2, err := mirror.Clone(filepath.Join(t.TempDir(), "b"), origin, "master", nil)
+	if err != nil || hash2 != next || hash2 == hash {
+		t.Errorf("second clone = %s, %v, want %s", hash2, err, next)
+	}
+}
+
+func TestCloneRef(t *testing.T) {
+	origin, repository := newTestRepo(t)
+	first := commitFile(t, repository, "main.go", "feat: first")
+	repository.CreateTag("v1.0.0", plumbing.NewHash(first), &git.CreateTagOptions{Tagger: &testSignature, Message: "v1.0.0"})
+	second := commitFile(t, repository, "main.go", "fix: second")
+	third := commitFile(t, repository, "main.go", "fix: third")
+
+	for _, tc := range []struct {
+		ref     string
+		kind    RefKind
+		hash    string
+		version string
+	}{
+		{"v1.0.0", RefTag, first, "v1.0.0"},
+		{"master", RefBranch, third, "v1.0.0-2-g" + third[:7]},
+		{second, RefCommit, second, "v1.0.0-1-g" + second[:7]},
+	} {
+		result, err := CloneRef(filepath.Join(t.TempDir(), "clone"), CloneOptions{URL: origin, Ref: tc.ref})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.ref, err)
+		}
+		if result.Hash != tc.hash || result.Ref.Kind != tc.kind || result.Version != tc.version {
+			t.Errorf("%s: hash %s kind %s version %s", tc.ref, result.Hash, result.Ref.Kind, result.Version)
+		}
+	}
+
+	result, err := CloneRef(filepath.Join(t.TempDir(), "clone"), CloneOptions{URL: origin, Ref: "v1.0.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Author != "gtools" || result.Message != "feat: first" || len(result.Tags) != 1 || result.Tags[0] != "v1.0.0" {
+		t.Errorf("result = %+v", result)
+	}
+	if _, err := CloneRef(filepath.Join(t.TempDir(), "clone"), CloneOptions{URL: origin, Ref: "release"}); err == nil {
+		t.Error("expected an error for an unknown ref")
+	}
+}
+
+func TestNewChangelog(t *testing.T) {
+	_, repository := newTestRepo(t, "init")
+	base, _ := repository.Head()
+	commitFile(t, repository, "api/server.go", "feat(api)!: stream logs")
+	commitFile(t, repository, "README.md", "fix: typo in readme")
+	commitFile(t, repository, "Makefile", "update makefile")
+
+	changelog, err := NewChangelog(repository, base.Hash().String(), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changelog.Commits) != 3 {
+		t.Fatalf("commits = %+v", changelog.Commits)
+	}
+	var types []string
+	for _, group := range changelog.Groups {
+		types = append(types, fmt.Sprintf("%s:%d", group.Type, len(group.Commits)))
+	}
+	if strings.Join(types, ",") != "feat:1,fix:1,other:1" {
+		t.Errorf("groups = %v", types)
+	}
+	feat := changelog.Groups[0].Commits[0]
+	if feat.Scope != "api" || !feat.Breaking || feat.Subject != "stream logs" || len(feat.Files) != 1 || feat.Files[0].Name != "api/server.go" {
+		t.Errorf("feat = %+v", feat)
+	}
+	if len(changelog.Files) != 3 {
+		t.Errorf("files = %+v", changelog.Files)
+	}
+	if markdown := changelog.Markdown(); !strings.Contains(markdown, "BREAKING api: stream logs") || !strings.Contains(markdown, "3 files changed") {
+		t.Errorf("markdown = %s", markdown)
+	}
+}
+
+func TestNewChangelog_Shallow(t *testing.T) {
+	origin, repository := newTestRepo(t, "init")
+	commitFile(t, repository, "main.go", "feat: first")
+	commitFile(t, repository, "main.go", "fix: second")
+
+	result, err := CloneRef(filepath.Join(t.TempDir(), "clone"), CloneOptions{URL: "file://" + origin, Depth: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	changelog, err := NewChangelog(result.Repository, "HEAD~1", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changelog.Commits) != 1 || changelog.Commits[0].Subject != "second" || len(changelog.Commits[0].Files) != 1 {
+		t.Errorf("commits = %+v", changelog.Commits)
+	}
+	changelog, err = NewChangelog(result.Repository, "", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changelog.Commits) != 2 || changelog.Commits[1].Subject != "first" || len(changelog.Commits[1].Files) != 0 {
+		t.Errorf("commits to the boundary = %+v", changelog.Commits)
+	}
+}
+
+func TestCheckout_Push(t *testing.T) {
+	source, _ := newTestRepo(t, "init")
+	origin := filepath.Join(t.TempDir(), "origin.git")
+	if _, err := git.PlainClone(origin, true, &git.CloneOptions{URL: source}); err != nil {
+		t.Fatal(err)
+	}
+	open := func(name string) *Checkout {
+		dir := filepath.Join(t.TempDir(), name)
+		if _, err := Clone(dir, origin, "master", 0, nil); err != nil {
+			t.Fatal(err)
+		}
+		checkout, err := Open(dir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkout.Author = &Author{Name: "cd-bot", Email: "cd@example.com"}
+		return checkout
+	}
+	write := func(c *Checkout, name, content string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(c.Dir, name)), 0o755)
+		os.WriteFile(filepath.Join(c.Dir, name), []byte(content), 0o644)
+	}
+	a, b := open("a"), open("b")
+
+	if _, err := a.Commit("nothing"); !errors.Is(err, git.ErrEmptyCommit) {
+		t.Errorf("empty commit err = %v", err)
+	}
+	write(a, "apps/web/values.yaml", "tag: 1.1\n")
+	a.Add()
+	if _, err := a.Commit("chore: bump web"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Push(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	write(b, "apps/api/values.yaml", "tag: 2.0\n")
+	write(b, "apps/api/notes.txt", "draft\n")
+	os.Symlink("values.yaml", filepath.Join(b.Dir, "apps/api/current"))
+	b.Add("apps/api/values.yaml", "apps/api/current")
+	lib := plumbing.NewHash("1111111111111111111111111111111111111111")
+	if err := b.setGitlink("vendor/lib", lib); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Commit("chore: bump api"); err != nil {
+		t.Fatal(err)
+	}
+	worktree, _ := b.Repository.Worktree()
+	if status, _ := worktree.Status(); status.File("apps/api/notes.txt").Staging != git.Untracked {
+		t.Errorf("notes.txt staged: %v", status)
+	}
+	if err := b.Tag("api-2.0", "api 2.0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Push(nil, "api-2.0"); err != nil {
+		t.Fatalf("push after rebase: %v", err)
+	}
+
+	bare, _ := git.PlainOpen(origin)
+	changelog, err := NewChangelog(bare, "", "refs/heads/master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var subjects []string
+	for _, commit := range changelog.Commits {
+		subjects = append(subjects, commit.Subject)
+	}
+	if strings.Join(subjects, ",") != "bump api,bump web,init" {
+		t.Errorf("origin log = %v", subjects)
+	}
+	if changelog.Commits[0].Author != "cd-bot" {
+		t.Errorf("author = %s", changelog.Commits[0].Author)
+	}
+	tag, err := Resolve(bare, "api-2.0")
+	if err != nil || tag.Hash != changelog.Commits[0].Hash {
+		t.Errorf("tag = %+v, %v", tag, err)
+	}
+	commit, _ := bare.CommitObject(plumbing.NewHash(changelog.Commits[0].Hash))
+	tree, _ := commit.Tree()
+	if entry, err := tree.FindEntry("apps/api/current"); err != nil || entry.Mode != filemode.Symlink {
+		t.Errorf("symlink = %+v, %v", entry, err)
+	}
+	if entry, err := tree.FindEntry("vendor/lib"); err != nil || entry.Mode != filemode.Submodule || entry.Hash != lib {
+		t.Errorf("gitlink = %+v, %v", entry, err)
+	}
+	if _, err := tree.FindEntry("apps/api/notes.txt"); err == nil {
+		t.Error("unstaged notes.txt pushed")
+	}
+
+	write(a, "apps/api/values.yaml", "tag: 3.0\n")
+	a.Add()
+	a.Commit("chore: conflicting bump")
+	if err := a.Push(nil); !errors.Is(err, ErrRebaseConflict) {
+		t.Errorf("conflict err = %v", err)
+	}
+}
+
+func TestCloneRef_Submodules(t *testing.T) {
+	lib, _ := newTestRepo(t, "lib")
+	origin, repository := newTestRepo(t, "init")
+	libRepository, _ := git.PlainOpen(lib)
+	libHead, _ := libRepository.Head()
+
+	worktree, _ := repository.Worktree()
+	gitmodules := fmt.Sprintf("[submodule \"lib\"]\n\tpath = lib\n\turl = %s\n", lib)
+	os.WriteFile(filepath.Join(origin, ".gitmodules"), []byte(gitmodules), 0o644)
+	worktree.Add(".gitmodules")
+	index, _ := repository.Storer.Index()
+	entry := index.Add("lib")
+	entry.Hash, entry.Mode = libHead.Hash(), filemode.Submodule
+	repository.Storer.SetIndex(index)
+	if _, err := worktree.Commit("add lib", &git.CommitOptions{Author: &testSignature}); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "clone")
+	if _, err := CloneRef(dir, CloneOptions{URL: origin, Submodules: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, "lib", "README.md")); err != nil || string(data) != "lib\n" {
+		t.Errorf("submodule file = %q, %v", data, err)
+	}
+	plain := filepath.Join(t.TempDir(), "plain")
+	if _, err := CloneRef(plain, CloneOptions{URL: origin}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(plain, "lib", "README.md")); !os.IsNotExist(err) {
+		t.Errorf("submodule initialised without Submodules: %v", err)
+	}
+}
+
+func TestCloneRef_Sparse(t *testing.T) {
+	origin, repository := newTestRepo(t, "init")
+	commitFile(t, repository, "services/api/main.go", "package api")
+	commitFile(t, repository, "services/web/main.go", "package web")
+
+	dir := filepath.Join(t.TempDir(), "clone")
+	if _, err := CloneRef(dir, CloneOptions{URL: origin, Ref: "master", SparsePaths: []string{"services/api"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "services", "api", "main.go")); err != nil {
+		t.Errorf("sparse path missing: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "services", "web", "main.go")); !os.IsNotExist(err) {
+		t.Errorf("path outside the sparse checkout: %v", err)
+	}
+	_, err := CloneRef(filepath.Join(t.TempDir(), "both"), CloneOptions{URL: origin, SparsePaths: []string{"services"}, Submodules: 1})
+	if !errors.Is(err, ErrSparseSubmodules) {
+		t.Errorf("sparse with submodules err = %v", err)
+	}
 }
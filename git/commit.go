@@ -0,0 +1,399 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+var (
+	ErrDetachedHead   = errors.New("HEAD is not on a branch")
+	ErrRebaseConflict = errors.New("rebase conflict")
+)
+
+// pushRetries bounds the fetch, rebase and push rounds of Push.
+const pushRetries = 3
+
+// Author signs commits and tags. Without one the user of the git config is used.
+type Author struct {
+	Name  string
+	Email string
+}
+
+func (c *Checkout) signature() *object.Signature {
+	if c.Author == nil {
+		return nil
+	}
+	return &object.Signature{Name: c.Author.Name, Email: c.Author.Email, When: time.Now()}
+}
+
+// Add stages paths like git add -A, all changes of the working copy without paths.
+func (c *Checkout) Add(paths ...string) error {
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return worktree.AddWithOptions(&git.AddOptions{All: true})
+	}
+	for _, path := range paths {
+		if _, err := worktree.Add(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit commits the staged changes as Author and returns the hash, or
+// git.ErrEmptyCommit when nothing is staged.
+func (c *Checkout) Commit(message string) (string, error) {
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return "", err
+	}
+	status, err := worktree.Status()
+	if err != nil {
+		return "", err
+	}
+	staged := false
+	for _, file := range status {
+		staged = staged || (file.Staging != git.Unmodified && file.Staging != git.Untracked)
+	}
+	if !staged {
+		return "", git.ErrEmptyCommit
+	}
+	hash, err := worktree.Commit(message, &git.CommitOptions{Author: c.signature()})
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// Tag creates the annotated tag name at HEAD.
+func (c *Checkout) Tag(name, message string) error {
+	head, err := c.Repository.Head()
+	if err != nil {
+		return err
+	}
+	_, err = c.Repository.CreateTag(name, head.Hash(), &git.CreateTagOptions{Tagger: c.signature(), Message: message})
+	return err
+}
+
+// Push pushes the current branch and tags to origin. When origin moved on, the
+// local commits are rebased onto it and the push retried; files changed on
+// both sides stop the rebase with ErrRebaseConflict and leave the branch as it was.
+func (c *Checkout) Push(progress sideband.Progress, tags ...string) error {
+	head, err := c.Repository.Head()
+	if err != nil {
+		return err
+	}
+	if !head.Name().IsBranch() {
+		return ErrDetachedHead
+	}
+	url, err := c.URL()
+	if err != nil {
+		return err
+	}
+	method, err := c.Auth.method(url)
+	if err != nil {
+		return err
+	}
+	refSpecs := []config.RefSpec{config.RefSpec(fmt.Sprintf("%s:%s", head.Name(), head.Name()))}
+	for _, tag := range tags {
+		name := plumbing.NewTagReferenceName(tag)
+		refSpecs = append(refSpecs, config.RefSpec(fmt.Sprintf("%s:%s", name, name)))
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = c.Repository.Push(&git.PushOptions{
+			RemoteName: git.DefaultRemoteName,
+			RefSpecs:   refSpecs,
+			Auth:       method,
+			Progress:   progress,
+		})
+		if errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil
+		}
+		if !nonFastForward(err) || attempt == pushRetries {
+			return err
+		}
+		if err := c.Fetch(progress); err != nil {
+			return err
+		}
+		if err := c.rebase(head.Name().Short()); err != nil {
+			return err
+		}
+	}
+}
+
+func nonFastForward(err error) bool {
+	return err != nil && (errors.Is(err, git.ErrNonFastForwardUpdate) || strings.Contains(err.Error(), "non-fast-forward"))
+}
+
+// rebase replays the commits of branch missing on origin onto origin, file by
+// file. Annotated tags on the replayed commits are moved along.
+func (c *Checkout) rebase(branch string) error {
+	localRef, err := c.Repository.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		return err
+	}
+	remoteRef, err := c.Repository.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, branch), true)
+	if err != nil {
+		return err
+	}
+	local, err := c.Repository.CommitObject(localRef.Hash())
+	if err != nil {
+		return err
+	}
+	remote, err := c.Repository.CommitObject(remoteRef.Hash())
+	if err != nil {
+		return err
+	}
+	bases, err := local.MergeBase(remote)
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		return fmt.Errorf("%w: no common history with origin", ErrRebaseConflict)
+	}
+	base := bases[0]
+	if base.Hash == remote.Hash {
+		return nil
+	}
+
+	var commits []*object.Commit
+	for commit := local; commit.Hash != base.Hash; {
+		if commit.NumParents() != 1 {
+			return fmt.Errorf("%w: cannot replay merge commit %s", ErrRebaseConflict, commit.Hash)
+		}
+		commits = append([]*object.Commit{commit}, commits...)
+		if commit, err = commit.Parent(0); err != nil {
+			return err
+		}
+	}
+	localChanges, err := changedFiles(base, local)
+	if err != nil {
+		return err
+	}
+	remoteChanges, err := changedFiles(base, remote)
+	if err != nil {
+		return err
+	}
+	for name := range localChanges {
+		if remoteChanges[name] {
+			return fmt.Errorf("%w: %s changed on both sides", ErrRebaseConflict, name)
+		}
+	}
+
+	tags, err := tagsByCommit(c.Repository)
+	if err != nil {
+		return err
+	}
+	if err := c.moveBranch(branch, remote.Hash); err != nil {
+		return err
+	}
+	// tags move once every commit replayed, a failed rebase leaves them alone
+	moved := map[string]plumbing.Hash{}
+	for _, commit := range commits {
+		hash, err := c.replay(commit)
+		if err != nil {
+			c.moveBranch(branch, local.Hash)
+			return err
+		}
+		for _, name := range tags[commit.Hash] {
+			moved[name] = hash
+		}
+	}
+	for name, hash := range moved {
+		if err := c.moveTag(name, hash); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changedFiles lists the paths that differ between the trees of from and to.
+func changedFiles(from, to *object.Commit) (map[string]bool, error) {
+	fromTree, err := from.Tree()
+	if err != nil {
+		return nil, err
+	}
+	toTree, err := to.Tree()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := object.DiffTree(fromTree, toTree)
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, change := range changes {
+		if change.From.Name != "" {
+			names[change.From.Name] = true
+		}
+		if change.To.Name != "" {
+			names[change.To.Name] = true
+		}
+	}
+	return names, nil
+}
+
+// moveBranch points branch at hash and checks it out, dropping local changes.
+func (c *Checkout) moveBranch(branch string, hash plumbing.Hash) error {
+	name := plumbing.NewBranchReferenceName(branch)
+	if err := c.Repository.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+		return err
+	}
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return err
+	}
+	return worktree.Checkout(&git.CheckoutOptions{Branch: name, Force: true})
+}
+
+// replay applies the changes of commit to the working copy and commits them
+// with its author and message.
+func (c *Checkout) replay(commit *object.Commit) (plumbing.Hash, error) {
+	parent, err := commit.Parent(0)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	parentTree, err := parent.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	changes, err := object.DiffTree(parentTree, tree)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	worktree, err := c.Repository.Worktree()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	for _, change := range changes {
+		if change.From.Name != "" && change.From.Name != change.To.Name {
+			if change.From.TreeEntry.Mode == filemode.Submodule {
+				err = c.setGitlink(change.From.Name, plumbing.ZeroHash)
+			} else {
+				_, err = worktree.Remove(change.From.Name)
+			}
+			if err != nil {
+				return plumbing.ZeroHash, err
+			}
+		}
+		if change.To.Name == "" {
+			continue
+		}
+		// a submodule is only a commit in the index, its checkout is left as it is
+		if change.To.TreeEntry.Mode == filemode.Submodule {
+			if err := c.setGitlink(change.To.Name, change.To.TreeEntry.Hash); err != nil {
+				return plumbing.ZeroHash, err
+			}
+			continue
+		}
+		file, err := tree.File(change.To.Name)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if err := c.writeFile(file); err != nil {
+			return plumbing.ZeroHash, err
+		}
+		if _, err := worktree.Add(change.To.Name); err != nil {
+			return plumbing.ZeroHash, err
+		}
+	}
+	committer := c.signature()
+	if committer == nil {
+		committer = &object.Signature{Name: commit.Committer.Name, Email: commit.Committer.Email, When: time.Now()}
+	}
+	author := commit.Author
+	return worktree.Commit(commit.Message, &git.CommitOptions{Author: &author, Committer: committer})
+}
+
+// setGitlink points the submodule entry name of the index at hash, a zero hash removes it.
+func (c *Checkout) setGitlink(name string, hash plumbing.Hash) error {
+	idx, err := c.Repository.Storer.Index()
+	if err != nil {
+		return err
+	}
+	if hash.IsZero() {
+		idx.Remove(name)
+	} else {
+		entry, err := idx.Entry(name)
+		if err != nil {
+			entry = idx.Add(name)
+		}
+		entry.Hash, entry.Mode = hash, filemode.Submodule
+	}
+	return c.Repository.Storer.SetIndex(idx)
+}
+
+// writeFile writes file to the working copy, a symlink as a link to its content.
+func (c *Checkout) writeFile(file *object.File) error {
+	path := filepath.Join(c.Dir, filepath.FromSlash(file.Name))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	// never write through a symlink that is replaced by a file
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if file.Mode == filemode.Symlink {
+		target, err := file.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(target, path)
+	}
+	mode := os.FileMode(0o644)
+	if file.Mode == filemode.Executable {
+		mode = 0o755
+	}
+	reader, err := file.Reader()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, reader)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// moveTag recreates tag at hash, keeping the tagger and message of an annotated tag.
+func (c *Checkout) moveTag(name string, hash plumbing.Hash) error {
+	ref, err := c.Repository.Tag(name)
+	if err != nil {
+		return err
+	}
+	var options *git.CreateTagOptions
+	if tag, err := c.Repository.TagObject(ref.Hash()); err == nil {
+		tagger := tag.Tagger
+		options = &git.CreateTagOptions{Tagger: &tagger, Message: tag.Message}
+	}
+	if err := c.Repository.DeleteTag(name); err != nil {
+		return err
+	}
+	_, err = c.Repository.CreateTag(name, hash, options)
+	return err
+}
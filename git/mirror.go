@@ -0,0 +1,128 @@
+package git
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// Mirror keeps a bare mirror per url under Dir, working copies are cloned from
+// it locally and only the new objects come over the network.
+// A Mirror is safe for concurrent use within one process.
+type Mirror struct {
+	Dir  string
+	Auth *Auth
+
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+func NewMirror(dir string, auth *Auth) *Mirror {
+	return &Mirror{Dir: dir, Auth: auth, locks: map[string]*sync.Mutex{}}
+}
+
+var unsafeName = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// Path is the mirror directory of url, a readable name plus a hash of the url.
+func (m *Mirror) Path(url string) string {
+	name := url
+	if i := strings.Index(name, "://"); i >= 0 {
+		name = name[i+3:]
+	}
+	if i := strings.LastIndex(name, "@"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.Trim(unsafeName.ReplaceAllString(strings.TrimSuffix(name, ".git"), "_"), "_.")
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(m.Dir, name+"-"+hex.EncodeToString(sum[:4])+".git")
+}
+
+func (m *Mirror) lock(url string) func() {
+	m.mu.Lock()
+	if m.locks == nil {
+		m.locks = map[string]*sync.Mutex{}
+	}
+	lock, ok := m.locks[url]
+	if !ok {
+		lock = &sync.Mutex{}
+		m.locks[url] = lock
+	}
+	m.mu.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// Sync creates the mirror of url or fetches every ref into it, and returns its path.
+func (m *Mirror) Sync(url string, progress sideband.Progress) (string, error) {
+	defer m.lock(url)()
+	return m.sync(url, progress)
+}
+
+func (m *Mirror) sync(url string, progress sideband.Progress) (string, error) {
+	path := m.Path(url)
+	method, err := m.Auth.method(url)
+	if err != nil {
+		return "", err
+	}
+	repository, err := git.PlainOpen(path)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		if _, err := git.PlainClone(path, true, &git.CloneOptions{URL: url, Auth: method, Mirror: true, Progress: progress}); err != nil {
+			os.RemoveAll(path)
+			return "", err
+		}
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	err = repository.Fetch(&git.FetchOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{"+refs/*:refs/*"},
+		Auth:       method,
+		Force:      true,
+		Prune:      true,
+		Progress:   progress,
+	})
+	if errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return path, nil
+	}
+	return path, err
+}
+
+// Clone syncs the mirror of url and clones a working copy at dir from it,
+// checked out at ref like Checkout.Reset. origin of the copy points to url.
+func (m *Mirror) Clone(dir, url, ref string, progress sideband.Progress) (*Checkout, string, error) {
+	unlock := m.lock(url)
+	path, err := m.sync(url, progress)
+	if err != nil {
+		unlock()
+		return nil, "", err
+	}
+	repository, err := git.PlainClone(dir, false, &git.CloneOptions{URL: path, NoCheckout: true, Tags: git.AllTags})
+	unlock()
+	if err != nil {
+		return nil, "", err
+	}
+	if err := repository.DeleteRemote(git.DefaultRemoteName); err != nil {
+		return nil, "", err
+	}
+	_, err = repository.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}})
+	if err != nil {
+		return nil, "", err
+	}
+	checkout := &Checkout{Dir: dir, Repository: repository, Auth: m.Auth}
+	hash, err := checkout.Reset(ref)
+	if err != nil {
+		return nil, "", err
+	}
+	return checkout, hash, nil
+}
@@ -0,0 +1,161 @@
+package git
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+type RefKind int
+
+const (
+	RefBranch RefKind = iota
+	RefTag
+	RefCommit
+)
+
+func (k RefKind) String() string {
+	switch k {
+	case RefBranch:
+		return "branch"
+	case RefTag:
+		return "tag"
+	default:
+		return "commit"
+	}
+}
+
+// Ref is a resolved branch, tag or commit.
+type Ref struct {
+	Name string
+	Kind RefKind
+	Hash string
+}
+
+var hexPrefix = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// Resolve finds the commit of ref in repository, trying the branches of origin,
+// then tags, then local branches, then commit hashes and anything else git
+// rev-parse accepts.
+func Resolve(repository *git.Repository, ref string) (Ref, error) {
+	if remote, err := repository.Reference(plumbing.NewRemoteReferenceName(git.DefaultRemoteName, ref), true); err == nil {
+		return Ref{Name: ref, Kind: RefBranch, Hash: remote.Hash().String()}, nil
+	}
+	if tag, err := repository.Reference(plumbing.NewTagReferenceName(ref), true); err == nil {
+		hash, err := peel(repository, tag.Hash())
+		return Ref{Name: ref, Kind: RefTag, Hash: hash.String()}, err
+	}
+	if branch, err := repository.Reference(plumbing.NewBranchReferenceName(ref), true); err == nil {
+		return Ref{Name: ref, Kind: RefBranch, Hash: branch.Hash().String()}, nil
+	}
+	revision, err := repository.ResolveRevision(plumbing.Revision(ref))
+	if err != nil {
+		return Ref{}, fmt.Errorf("resolve %s: %w", ref, err)
+	}
+	return Ref{Name: ref, Kind: RefCommit, Hash: revision.String()}, nil
+}
+
+// remoteKind tells from the refs of url whether ref is a branch or a tag there,
+// anything else that looks like a hash is taken for a commit.
+func remoteKind(url, ref string, auth *Auth) (RefKind, error) {
+	method, err := auth.method(url)
+	if err != nil {
+		return 0, err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{url}})
+	refs, err := remote.List(&git.ListOptions{Auth: method})
+	if err != nil {
+		return 0, err
+	}
+	for _, remoteRef := range refs {
+		switch remoteRef.Name() {
+		case plumbing.NewBranchReferenceName(ref):
+			return RefBranch, nil
+		case plumbing.NewTagReferenceName(ref):
+			return RefTag, nil
+		}
+	}
+	if hexPrefix.MatchString(ref) {
+		return RefCommit, nil
+	}
+	return 0, fmt.Errorf("resolve %s: %w", ref, plumbing.ErrReferenceNotFound)
+}
+
+// peel returns the commit of an annotated tag, other hashes unchanged.
+func peel(repository *git.Repository, hash plumbing.Hash) (plumbing.Hash, error) {
+	tag, err := repository.TagObject(hash)
+	if errors.Is(err, plumbing.ErrObjectNotFound) {
+		return hash, nil
+	}
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	commit, err := tag.Commit()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return commit.Hash, nil
+}
+
+// tagsByCommit maps commit hashes to the sorted names of the tags pointing at them.
+func tagsByCommit(repository *git.Repository) (map[plumbing.Hash][]string, error) {
+	iter, err := repository.Tags()
+	if err != nil {
+		return nil, err
+	}
+	tags := map[plumbing.Hash][]string{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		hash, err := peel(repository, ref.Hash())
+		if err != nil {
+			return err
+		}
+		tags[hash] = append(tags[hash], ref.Name().Short())
+		return nil
+	})
+	for _, names := range tags {
+		sort.Strings(names)
+	}
+	return tags, err
+}
+
+// Describe names hash like git describe --tags --always: the nearest tag, with
+// the commit distance and abbreviated hash when hash is not tagged itself, or
+// just the abbreviated hash without reachable tags.
+func Describe(repository *git.Repository, hash string) (string, error) {
+	tags, err := tagsByCommit(repository)
+	if err != nil {
+		return "", err
+	}
+	return describe(repository, plumbing.NewHash(hash), tags)
+}
+
+func describe(repository *git.Repository, hash plumbing.Hash, tags map[plumbing.Hash][]string) (string, error) {
+	short := hash.String()[:7]
+	iter, err := repository.Log(&git.LogOptions{From: hash, Order: git.LogOrderBSF})
+	if err != nil {
+		return "", err
+	}
+	defer iter.Close()
+	distance := 0
+	for {
+		commit, err := iter.Next()
+		if err != nil {
+			// end of history, or the boundary of a shallow clone
+			return short, nil
+		}
+		if names := tags[commit.Hash]; len(names) > 0 {
+			tag := names[len(names)-1]
+			if distance == 0 {
+				return tag, nil
+			}
+			return fmt.Sprintf("%s-%d-g%s", tag, distance, short), nil
+		}
+		distance++
+	}
+}
@@ -0,0 +1,331 @@
+// Package webhook receives push and tag events from GitHub, GitLab and Gitea
+// and normalizes them into one Event.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/Nname/gtools/git"
+)
+
+type Provider string
+
+const (
+	GitHub Provider = "github"
+	GitLab Provider = "gitlab"
+	Gitea  Provider = "gitea"
+)
+
+const (
+	EventPush = "push"
+	EventTag  = "tag"
+)
+
+var (
+	ErrSignature        = errors.New("webhook signature mismatch")
+	ErrUnknownProvider  = errors.New("webhook from an unknown provider")
+	ErrUnsupportedEvent = errors.New("unsupported webhook event")
+)
+
+// DefaultMaxBodySize is the largest payload GitHub sends.
+const DefaultMaxBodySize = 25 << 20
+
+const zeroHash = "0000000000000000000000000000000000000000"
+
+// Commit is one pushed commit.
+type Commit struct {
+	ID       string   `json:"id"`
+	Message  string   `json:"message"`
+	Author   string   `json:"author"`
+	Email    string   `json:"email"`
+	URL      string   `json:"url"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// Event is a push of a branch or a tag. URL is the http clone url, the one to
+// pass to git.Clone unless the ssh url is preferred.
+type Event struct {
+	Provider   Provider `json:"provider"`
+	Type       string   `json:"type"`
+	Repository string   `json:"repository"`
+	URL        string   `json:"url"`
+	SSHURL     string   `json:"ssh_url"`
+	WebURL     string   `json:"web_url"`
+
+	// Ref is the full ref, Branch or Tag its short name
+	Ref    string `json:"ref"`
+	Branch string `json:"branch,omitempty"`
+	Tag    string `json:"tag,omitempty"`
+
+	Before  string   `json:"before"`
+	After   string   `json:"after"`
+	Deleted bool     `json:"deleted"`
+	Pusher  string   `json:"pusher"`
+	Commits []Commit `json:"commits"`
+}
+
+// ChangedFiles lists the files added, modified or removed by the commits, once each.
+func (e *Event) ChangedFiles() []string {
+	seen := map[string]bool{}
+	var files []string
+	for _, commit := range e.Commits {
+		for _, list := range [][]string{commit.Added, commit.Modified, commit.Removed} {
+			for _, file := range list {
+				if !seen[file] {
+					seen[file] = true
+					files = append(files, file)
+				}
+			}
+		}
+	}
+	return files
+}
+
+// CloneOptions checks out the pushed branch or tag of URL for git.CloneRef. The
+// branch may have moved on since, compare the Hash of the result with After.
+func (e *Event) CloneOptions(auth *git.Auth) git.CloneOptions {
+	return git.CloneOptions{URL: e.URL, Ref: firstNonEmpty(e.Tag, e.Branch), Depth: 1, Auth: auth}
+}
+
+// Handler verifies and parses webhooks and passes push and tag events to OnEvent.
+// Other events, like the GitHub ping, are acknowledged and dropped.
+type Handler struct {
+	// Secret is the HMAC key of GitHub and Gitea, or the GitLab token.
+	// An empty Secret accepts unsigned requests.
+	Secret string
+
+	// OnEvent runs before the response, a slow consumer should hand the event off
+	OnEvent func(r *http.Request, event *Event) error
+
+	// MaxBodySize defaults to DefaultMaxBodySize
+	MaxBodySize int64
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := h.MaxBodySize
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, limit)
+	event, err := Parse(r, h.Secret)
+	switch {
+	case errors.Is(err, ErrSignature):
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	case errors.Is(err, ErrUnsupportedEvent):
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if h.OnEvent != nil {
+		if err := h.OnEvent(r, event); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// Parse reads the body of r, verifies it against secret and normalizes the
+// push or tag event. The provider is told by the event header.
+func Parse(r *http.Request, secret string) (*Event, error) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case r.Header.Get("X-Gitea-Event") != "":
+		if err := verifyHMAC(secret, r.Header.Get("X-Gitea-Signature"), body); err != nil {
+			return nil, err
+		}
+		if r.Header.Get("X-Gitea-Event") != "push" {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedEvent, r.Header.Get("X-Gitea-Event"))
+		}
+		return parseHub(Gitea, body)
+	case r.Header.Get("X-GitHub-Event") != "":
+		signature, ok := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+		if !ok && secret != "" {
+			return nil, ErrSignature
+		}
+		if err := verifyHMAC(secret, signature, body); err != nil {
+			return nil, err
+		}
+		if r.Header.Get("X-GitHub-Event") != "push" {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedEvent, r.Header.Get("X-GitHub-Event"))
+		}
+		return parseHub(GitHub, body)
+	case r.Header.Get("X-Gitlab-Event") != "":
+		token := r.Header.Get("X-Gitlab-Token")
+		if secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			return nil, ErrSignature
+		}
+		switch r.Header.Get("X-Gitlab-Event") {
+		case "Push Hook", "Tag Push Hook":
+			return parseGitLab(body)
+		default:
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedEvent, r.Header.Get("X-Gitlab-Event"))
+		}
+	default:
+		return nil, ErrUnknownProvider
+	}
+}
+
+func verifyHMAC(secret, signature string, body []byte) error {
+	if secret == "" {
+		return nil
+	}
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return ErrSignature
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return ErrSignature
+	}
+	return nil
+}
+
+type hubCommit struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	Author  struct {
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	} `json:"author"`
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+func (c hubCommit) commit() Commit {
+	return Commit{
+		ID:       c.ID,
+		Message:  c.Message,
+		Author:   c.Author.Name,
+		Email:    c.Author.Email,
+		URL:      c.URL,
+		Added:    c.Added,
+		Modified: c.Modified,
+		Removed:  c.Removed,
+	}
+}
+
+// hubPush is the push payload of GitHub, which Gitea mostly follows.
+type hubPush struct {
+	Ref        string `json:"ref"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		CloneURL string `json:"clone_url"`
+		SSHURL   string `json:"ssh_url"`
+		HTMLURL  string `json:"html_url"`
+	} `json:"repository"`
+	Pusher struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	Commits []hubCommit `json:"commits"`
+}
+
+func parseHub(provider Provider, body []byte) (*Event, error) {
+	var push hubPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+	event := &Event{
+		Provider:   provider,
+		Repository: push.Repository.FullName,
+		URL:        push.Repository.CloneURL,
+		SSHURL:     push.Repository.SSHURL,
+		WebURL:     push.Repository.HTMLURL,
+		Before:     push.Before,
+		After:      push.After,
+		Deleted:    push.Deleted,
+		Pusher:     firstNonEmpty(push.Pusher.Name, push.Pusher.Login, push.Pusher.Username),
+	}
+	for _, commit := range push.Commits {
+		event.Commits = append(event.Commits, commit.commit())
+	}
+	return event.setRef(push.Ref), nil
+}
+
+type gitLabPush struct {
+	ObjectKind   string `json:"object_kind"`
+	Ref          string `json:"ref"`
+	Before       string `json:"before"`
+	After        string `json:"after"`
+	UserName     string `json:"user_name"`
+	UserUsername string `json:"user_username"`
+	Project      struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		GitHTTPURL        string `json:"git_http_url"`
+		GitSSHURL         string `json:"git_ssh_url"`
+		WebURL            string `json:"web_url"`
+	} `json:"project"`
+	Commits []hubCommit `json:"commits"`
+}
+
+func parseGitLab(body []byte) (*Event, error) {
+	var push gitLabPush
+	if err := json.Unmarshal(body, &push); err != nil {
+		return nil, err
+	}
+	event := &Event{
+		Provider:   GitLab,
+		Repository: push.Project.PathWithNamespace,
+		URL:        push.Project.GitHTTPURL,
+		SSHURL:     push.Project.GitSSHURL,
+		WebURL:     push.Project.WebURL,
+		Before:     push.Before,
+		After:      push.After,
+		Deleted:    push.After == zeroHash,
+		Pusher:     firstNonEmpty(push.UserUsername, push.UserName),
+	}
+	for _, commit := range push.Commits {
+		event.Commits = append(event.Commits, commit.commit())
+	}
+	return event.setRef(push.Ref), nil
+}
+
+func (e *Event) setRef(ref string) *Event {
+	e.Ref = ref
+	e.Type = EventPush
+	if tag, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+		e.Type, e.Tag = EventTag, tag
+	} else {
+		e.Branch = strings.TrimPrefix(ref, "refs/heads/")
+	}
+	e.Deleted = e.Deleted || e.After == zeroHash
+	return e
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
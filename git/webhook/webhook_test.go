@@ -0,0 +1,150 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const hubPayload = `{
+	"ref": "refs/heads/main",
+	"before": "1111111111111111111111111111111111111111",
+	"after": "2222222222222222222222222222222222222222",
+	"repository": {"full_name": "acme/app", "clone_url": "https://example.com/acme/app.git", "ssh_url": "git@example.com:acme/app.git"},
+	"pusher": {"name": "alice", "login": "alice"},
+	"commits": [
+		{"id": "a", "message": "feat: x", "author": {"name": "Alice", "email": "a@example.com"}, "added": ["x.go"], "modified": ["go.mod"]},
+		{"id": "b", "message": "fix: y", "author": {"name": "Alice", "email": "a@example.com"}, "modified": ["go.mod", "y.go"], "removed": ["z.go"]}
+	]
+}`
+
+const gitLabPayload = `{
+	"object_kind": "tag_push",
+	"ref": "refs/tags/v1.2.0",
+	"before": "0000000000000000000000000000000000000000",
+	"after": "3333333333333333333333333333333333333333",
+	"user_name": "Bob",
+	"user_username": "bob",
+	"project": {"path_with_namespace": "acme/app", "git_http_url": "https://gitlab.example.com/acme/app.git", "git_ssh_url": "git@gitlab.example.com:acme/app.git"},
+	"commits": []
+}`
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		body    string
+		status  int
+		event   *Event
+	}{
+		{
+			name:    "github push",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("secret", hubPayload)},
+			body:    hubPayload,
+			status:  http.StatusAccepted,
+			event:   &Event{Provider: GitHub, Type: EventPush, Ref: "refs/heads/main", Branch: "main", Pusher: "alice"},
+		},
+		{
+			name:    "github bad signature",
+			headers: map[string]string{"X-GitHub-Event": "push", "X-Hub-Signature-256": "sha256=" + sign("other", hubPayload)},
+			body:    hubPayload,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:    "github ping",
+			headers: map[string]string{"X-GitHub-Event": "ping", "X-Hub-Signature-256": "sha256=" + sign("secret", "{}")},
+			body:    "{}",
+			status:  http.StatusNoContent,
+		},
+		{
+			name:    "gitea push",
+			headers: map[string]string{"X-Gitea-Event": "push", "X-GitHub-Event": "push", "X-Gitea-Signature": sign("secret", hubPayload)},
+			body:    hubPayload,
+			status:  http.StatusAccepted,
+			event:   &Event{Provider: Gitea, Type: EventPush, Ref: "refs/heads/main", Branch: "main", Pusher: "alice"},
+		},
+		{
+			name:    "gitlab tag",
+			headers: map[string]string{"X-Gitlab-Event": "Tag Push Hook", "X-Gitlab-Token": "secret"},
+			body:    gitLabPayload,
+			status:  http.StatusAccepted,
+			event:   &Event{Provider: GitLab, Type: EventTag, Ref: "refs/tags/v1.2.0", Tag: "v1.2.0", Pusher: "bob"},
+		},
+		{
+			name:    "gitlab bad token",
+			headers: map[string]string{"X-Gitlab-Event": "Push Hook", "X-Gitlab-Token": "guess"},
+			body:    gitLabPayload,
+			status:  http.StatusUnauthorized,
+		},
+		{
+			name:   "unknown provider",
+			body:   hubPayload,
+			status: http.StatusBadRequest,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got *Event
+			handler := &Handler{Secret: "secret", OnEvent: func(r *http.Request, event *Event) error {
+				got = event
+				return nil
+			}}
+			request := httptest.NewRequest(http.MethodPost, "/hook", strings.NewReader(test.body))
+			for key, value := range test.headers {
+				request.Header.Set(key, value)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, request)
+			if recorder.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", recorder.Code, test.status, recorder.Body)
+			}
+			if test.event == nil {
+				if got != nil {
+					t.Fatalf("unexpected event %+v", got)
+				}
+				return
+			}
+			if got.Provider != test.event.Provider || got.Type != test.event.Type || got.Ref != test.event.Ref ||
+				got.Branch != test.event.Branch || got.Tag != test.event.Tag || got.Pusher != test.event.Pusher {
+				t.Fatalf("event %+v, want %+v", got, test.event)
+			}
+			if got.URL == "" || got.After == "" || got.Repository != "acme/app" {
+				t.Fatalf("incomplete event %+v", got)
+			}
+		})
+	}
+}
+
+func TestEvent_ChangedFiles(t *testing.T) {
+	event, err := parseHub(GitHub, []byte(hubPayload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"x.go", "go.mod", "y.go", "z.go"}
+	if files := event.ChangedFiles(); !reflect.DeepEqual(files, want) {
+		t.Fatalf("files %v, want %v", files, want)
+	}
+	options := event.CloneOptions(nil)
+	if options.URL != "https://example.com/acme/app.git" || options.Ref != "main" {
+		t.Fatalf("clone options %+v", options)
+	}
+
+	deleted, err := parseGitLab([]byte(strings.Replace(gitLabPayload, "3333333333333333333333333333333333333333", zeroHash, 1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !deleted.Deleted {
+		t.Fatal("tag deletion not detected")
+	}
+}
@@ -0,0 +1,237 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	hostkeys "github.com/skeema/knownhosts"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMismatchError is returned when the server key differs from the one in known_hosts.
+type HostKeyMismatchError struct {
+	Host  string
+	Key   ssh.PublicKey
+	Known []knownhosts.KnownKey
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: got %s, known_hosts has %s",
+		e.Host, ssh.FingerprintSHA256(e.Key), e.Known[0].String())
+}
+
+// UnknownHostError is returned when the host is not in known_hosts and TrustOnFirstUse is off.
+type UnknownHostError struct {
+	Host string
+	Key  ssh.PublicKey
+}
+
+func (e *UnknownHostError) Error() string {
+	return fmt.Sprintf("unknown host %s with key %s", e.Host, ssh.FingerprintSHA256(e.Key))
+}
+
+// knownHostsLock serialises trust-on-first-use appends to known_hosts files.
+var knownHostsLock sync.Mutex
+
+func (c *Client) address() string {
+	return net.JoinHostPort(c.Host, fmt.Sprint(c.Port))
+}
+
+// clientConfig builds the ssh config. The returned cleanup closes the agent
+// connection and must be called once the ssh client is closed.
+func (c *Client) clientConfig() (*ssh.ClientConfig, agent.ExtendedAgent, func(), error) {
+	cleanup := func() {}
+	var agentClient agent.ExtendedAgent
+	if c.UseAgent || c.ForwardAgent {
+		conn, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("ssh agent: %w", err)
+		}
+		agentClient = agent.NewClient(conn)
+		cleanup = func() { conn.Close() }
+	}
+	auth, err := c.authMethods(agentClient)
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	hostKeyCallback, err := c.hostKeyCallback()
+	if err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	config := &ssh.ClientConfig{
+		Timeout:           time.Second * c.Timeout,
+		User:              c.User,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: c.hostKeyAlgorithms(),
+		Auth:              auth,
+	}
+	return config, agentClient, cleanup, nil
+}
+
+func (c *Client) authMethods(agentClient agent.ExtendedAgent) ([]ssh.AuthMethod, error) {
+	var auth []ssh.AuthMethod
+	signers, err := c.signers()
+	if err != nil {
+		return nil, err
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if c.UseAgent && agentClient != nil {
+		auth = append(auth, ssh.PublicKeysCallback(agentClient.Signers))
+	}
+	if c.Password != "" {
+		auth = append(auth, ssh.Password(c.Password))
+	}
+	switch {
+	case c.KeyboardInteractive != nil:
+		auth = append(auth, ssh.KeyboardInteractive(c.KeyboardInteractive))
+	case c.Password != "":
+		// many servers only offer keyboard-interactive for passwords
+		password := c.Password
+		auth = append(auth, ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			answers := make([]string, len(questions))
+			for i := range answers {
+				answers[i] = password
+			}
+			return answers, nil
+		}))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("no ssh auth method configured")
+	}
+	return auth, nil
+}
+
+// signers loads the private key and wraps it with the certificate when one is set.
+func (c *Client) signers() ([]ssh.Signer, error) {
+	key := c.PrivateKey
+	if len(key) == 0 && c.PrivateKeyPath != "" {
+		data, err := os.ReadFile(expandHome(c.PrivateKeyPath))
+		if err != nil {
+			return nil, err
+		}
+		key = data
+	}
+	if len(key) == 0 {
+		return nil, nil
+	}
+	var signer ssh.Signer
+	var err error
+	if c.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(c.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	certData := c.Certificate
+	if len(certData) == 0 && c.CertificatePath != "" {
+		if certData, err = os.ReadFile(expandHome(c.CertificatePath)); err != nil {
+			return nil, err
+		}
+	}
+	if len(certData) == 0 {
+		return []ssh.Signer{signer}, nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, errors.New("ssh: certificate file does not hold an OpenSSH certificate")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, err
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
+
+// hostKeyCallback verifies against KnownHostsPath. Without it the host key is not checked.
+func (c *Client) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if c.HostKeyCallback != nil {
+		return c.HostKeyCallback, nil
+	}
+	if c.KnownHostsPath == "" {
+		return ssh.InsecureIgnoreHostKey(), nil // not secure
+	}
+	path := expandHome(c.KnownHostsPath)
+	if c.TrustOnFirstUse {
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		file.Close()
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		knownHostsLock.Lock()
+		defer knownHostsLock.Unlock()
+		files := []string{path}
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			files = nil
+		}
+		check, err := knownhosts.New(files...)
+		if err != nil {
+			return err
+		}
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return &HostKeyMismatchError{Host: hostname, Key: key, Known: keyErr.Want}
+		}
+		if !c.TrustOnFirstUse {
+			return &UnknownHostError{Host: hostname, Key: key}
+		}
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+		return err
+	}, nil
+}
+
+// hostKeyAlgorithms limits the negotiation to the key types known_hosts has for
+// the host. Otherwise the server may pick a type that is not listed and fail the
+// check although it has a listed one. Unknown hosts keep the default list.
+func (c *Client) hostKeyAlgorithms() []string {
+	if c.HostKeyCallback != nil || c.KnownHostsPath == "" {
+		return nil
+	}
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	check, err := hostkeys.New(expandHome(c.KnownHostsPath))
+	if err != nil {
+		return nil
+	}
+	return check.HostKeyAlgorithms(c.address())
+}
+
+func expandHome(path string) string {
+	if len(path) > 1 && path[0] == '~' && (path[1] == '/' || path[1] == '\\') {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[2:])
+		}
+	}
+	return path
+}
@@ -0,0 +1,129 @@
+package ssh
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrSkipped = errors.New("skipped after failure threshold")
+
+// HostResult is the outcome of a command on one host of a batch.
+type HostResult struct {
+	Host       string
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+	Duration   time.Duration
+	Err        error
+}
+
+// Failed reports whether the command could not run or exited non-zero.
+func (r HostResult) Failed() bool {
+	return r.Err != nil || r.ExitStatus != 0
+}
+
+// Batch runs one command across many hosts.
+type Batch struct {
+	Hosts []*Client
+
+	// Concurrency caps the hosts running at once, 0 means all hosts of a wave
+	Concurrency int
+
+	// Timeout bounds each host, dial included
+	Timeout time.Duration
+
+	// BatchSize splits the hosts into waves run one after another, 0 means a single wave
+	BatchSize int
+
+	// FailureThreshold stops the batch once this many hosts failed, the hosts not
+	// started yet get ErrSkipped. 0 never stops.
+	FailureThreshold int
+}
+
+// Inventory copies template for every host, a host may carry its own port as host:port.
+func Inventory(template Client, hosts []string) []*Client {
+	clients := make([]*Client, 0, len(hosts))
+	for _, host := range hosts {
+		client := template
+		if name, port, err := net.SplitHostPort(host); err == nil {
+			client.Host = name
+			client.Port, _ = strconv.Atoi(port)
+		} else {
+			client.Host = host
+		}
+		clients = append(clients, &client)
+	}
+	return clients
+}
+
+// Run executes command on every host and returns one result per host in the order of Hosts.
+func (b *Batch) Run(ctx context.Context, command string) []HostResult {
+	results := make([]HostResult, len(b.Hosts))
+	for i, host := range b.Hosts {
+		results[i] = HostResult{Host: host.address(), Err: ErrSkipped}
+	}
+	size := b.BatchSize
+	if size <= 0 {
+		size = len(b.Hosts)
+	}
+
+	var mu sync.Mutex
+	failures := 0
+	stopped := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return ctx.Err() != nil || (b.FailureThreshold > 0 && failures >= b.FailureThreshold)
+	}
+	for start := 0; start < len(b.Hosts) && !stopped(); start += size {
+		end := min(start+size, len(b.Hosts))
+		limit := b.Concurrency
+		if limit <= 0 {
+			limit = end - start
+		}
+		sem := make(chan struct{}, limit)
+		var wg sync.WaitGroup
+		for i := start; i < end; i++ {
+			sem <- struct{}{}
+			if stopped() {
+				<-sem
+				break
+			}
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				result := b.runHost(ctx, b.Hosts[i], command)
+				mu.Lock()
+				results[i] = result
+				if result.Failed() {
+					failures++
+				}
+				mu.Unlock()
+			}(i)
+		}
+		wg.Wait()
+	}
+	return results
+}
+
+func (b *Batch) runHost(ctx context.Context, client *Client, command string) HostResult {
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+	start := time.Now()
+	result, err := client.Run(ctx, command)
+	return HostResult{
+		Host:       client.address(),
+		Stdout:     string(result.Stdout),
+		Stderr:     string(result.Stderr),
+		ExitStatus: result.ExitCode,
+		Duration:   time.Since(start),
+		Err:        err,
+	}
+}
@@ -1,9 +1,11 @@
 package ssh
 
 import (
-	"bufio"
+	"context"
 	"fmt"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"net"
 	"time"
 )
 
@@ -13,33 +15,170 @@ type Client struct {
 	User     string
 	Password string
 	Port     int
+
+	// PrivateKey (PEM) or PrivateKeyPath, Passphrase for encrypted keys
+	PrivateKey     []byte
+	PrivateKeyPath string
+	Passphrase     string
+
+	// Certificate or CertificatePath is an OpenSSH certificate for the private key
+	Certificate     []byte
+	CertificatePath string
+
+	// UseAgent authenticates with the identities of the agent at SSH_AUTH_SOCK,
+	// ForwardAgent also makes them available to the sessions on the remote host
+	UseAgent     bool
+	ForwardAgent bool
+
+	// KeyboardInteractive answers keyboard-interactive prompts, by default they are answered with Password
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+
+	// KnownHostsPath verifies host keys, unknown hosts are appended when TrustOnFirstUse is set.
+	// An empty path skips host key verification. HostKeyCallback overrides both.
+	KnownHostsPath  string
+	TrustOnFirstUse bool
+	HostKeyCallback ssh.HostKeyCallback
+
+	// Pool, when set, carries the sessions of RunCommand and friends over a shared connection
+	Pool *Pool
+
+	// Jump lists the bastions to go through, nearest first, like ProxyJump.
+	// Each hop authenticates and verifies its host key with its own settings,
+	// the Jump and Pool fields of a hop are not used.
+	Jump []*Client
 }
 
-func (c *Client) Connections() (*ssh.Client, *ssh.Session, error) {
-	config := &ssh.ClientConfig{
-		Timeout:         time.Second * c.Timeout,
-		User:            c.User,
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // not secure
-		Auth:            []ssh.AuthMethod{ssh.Password(c.Password)},
+// dial connects and authenticates to the host, through the Jump hosts when set.
+func (c *Client) dial() (*ssh.Client, error) {
+	var hops []*ssh.Client
+	closeHops := func() {
+		for i := len(hops) - 1; i >= 0; i-- {
+			hops[i].Close()
+		}
+	}
+	var via *ssh.Client
+	for _, hop := range c.Jump {
+		client, err := hop.dialVia(via)
+		if err != nil {
+			closeHops()
+			return nil, fmt.Errorf("jump host %s: %w", hop.address(), err)
+		}
+		hops = append(hops, client)
+		via = client
 	}
-	dial, err := ssh.Dial("tcp", fmt.Sprintf("%s:%d", c.Host, c.Port), config)
+	dial, err := c.dialVia(via)
 	if err != nil {
-		return nil, nil, err
+		closeHops()
+		return nil, err
+	}
+	if len(hops) > 0 {
+		go func() {
+			dial.Wait()
+			closeHops()
+		}()
 	}
+	return dial, nil
+}
+
+// dialVia connects directly, or tunnels the TCP connection through via when it is not nil.
+func (c *Client) dialVia(via *ssh.Client) (*ssh.Client, error) {
+	config, agentClient, cleanup, err := c.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if via == nil {
+		conn, err = net.DialTimeout("tcp", c.address(), config.Timeout)
+	} else {
+		conn, err = via.Dial("tcp", c.address())
+	}
+	if err != nil {
+		cleanup()
+		return nil, err
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, c.address(), config)
+	if err != nil {
+		conn.Close()
+		cleanup()
+		return nil, err
+	}
+	dial := ssh.NewClient(clientConn, chans, reqs)
+	if c.ForwardAgent {
+		if err := agent.ForwardToAgent(dial, agentClient); err != nil {
+			dial.Close()
+			cleanup()
+			return nil, err
+		}
+	}
+	go func() {
+		dial.Wait()
+		cleanup()
+	}()
+	return dial, nil
+}
+
+// newSession opens a session, requesting agent forwarding when ForwardAgent is set.
+func (c *Client) newSession(dial *ssh.Client) (*ssh.Session, error) {
 	session, err := dial.NewSession()
 	if err != nil {
+		return nil, err
+	}
+	if c.ForwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	return session, nil
+}
+
+// session opens a session from Pool, or on a new connection closed by release.
+func (c *Client) session() (session *ssh.Session, release func(), err error) {
+	if c.Pool != nil {
+		return c.Pool.Session(c)
+	}
+	connections, session, err := c.Connections()
+	if err != nil {
+		return nil, nil, err
+	}
+	return session, func() {
+		session.Close()
+		connections.Close()
+	}, nil
+}
+
+// conn returns the connection from Pool, or a new one closed by release.
+func (c *Client) conn() (client *ssh.Client, release func(), err error) {
+	if c.Pool != nil {
+		return c.Pool.Conn(c)
+	}
+	client, err = c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	return client, func() { client.Close() }, nil
+}
+
+func (c *Client) Connections() (*ssh.Client, *ssh.Session, error) {
+	dial, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	session, err := c.newSession(dial)
+	if err != nil {
+		dial.Close()
 		return nil, nil, err
 	}
 	return dial, session, nil
 }
 
+// RunCommand returns the combined output, the exit status is only in the error; see Run.
 func (c *Client) RunCommand(command string) (string, error) {
-	connections, session, err := c.Connections()
+	session, release, err := c.session()
 	if err != nil {
 		return "", err
 	}
-	defer session.Close()
-	defer connections.Close()
+	defer release()
 	output, err := session.CombinedOutput(command)
 	return string(output), err
 }
@@ -57,35 +196,12 @@ func (c *Client) RunCommands(commands []string) ([]string, error) {
 	return result, resultErr
 }
 
+// RunCommandPty runs command on a pty and prints its output lines as they arrive.
 func (c *Client) RunCommandPty(command string) {
-	connections, session, err := c.Connections()
-	if err != nil {
-		return
-	}
-	defer session.Close()
-	defer connections.Close()
-	session.RequestPty("xtrem", 120, 120, ssh.TerminalModes{})
-	Stdout, err := session.StdoutPipe()
+	_, err := c.stream(context.Background(), command, true, func(line Line) {
+		fmt.Println(line.Text)
+	})
 	if err != nil {
-		fmt.Println("StdoutPipe Error, ", err)
-	}
-	Stderr, err := session.StderrPipe()
-	if err != nil {
-		fmt.Println("StderrPipe Error, ", err)
-	}
-	StartErr := session.Start(command)
-	if err != nil {
-		fmt.Println("Start Error, ", StartErr)
-	}
-	StdoutScanner := bufio.NewScanner(Stdout)
-	for StdoutScanner.Scan() {
-		fmt.Println(StdoutScanner.Text())
-	}
-	StderrScanner := bufio.NewScanner(Stderr)
-	for StderrScanner.Scan() {
-		fmt.Println(StderrScanner.Text())
-	}
-	if WaitErr := session.Wait(); err != nil {
-		fmt.Println("WaitErr, ", WaitErr)
+		fmt.Println("RunCommandPty Error, ", err)
 	}
 }
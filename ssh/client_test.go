@@ -0,0 +1,581 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Nname/gtools/ssh/sshtest"
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func newTestKey(t *testing.T) (ed25519.PrivateKey, ssh.PublicKey) {
+	t.Helper()
+	pub, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return private, sshPub
+}
+
+func TestClient_HostKeyCallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	remote := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 2222}
+	_, key := newTestKey(t)
+	_, otherKey := newTestKey(t)
+
+	strict := &Client{KnownHostsPath: path}
+	callback, err := strict.hostKeyCallback()
+	if err == nil {
+		err = callback("10.0.0.1:2222", remote, key)
+	}
+	var unknown *UnknownHostError
+	if !errors.As(err, &unknown) {
+		t.Fatalf("unknown host err = %v", err)
+	}
+
+	tofu := &Client{KnownHostsPath: path, TrustOnFirstUse: true}
+	callback, err = tofu.hostKeyCallback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callback("10.0.0.1:2222", remote, key); err != nil {
+		t.Fatalf("first use: %v", err)
+	}
+	if err := callback("10.0.0.1:2222", remote, key); err != nil {
+		t.Fatalf("second use: %v", err)
+	}
+	var mismatch *HostKeyMismatchError
+	if err := callback("10.0.0.1:2222", remote, otherKey); !errors.As(err, &mismatch) {
+		t.Fatalf("mismatch err = %v", err)
+	}
+}
+
+func TestClient_KnownHostsAlgorithms(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("uname", sshtest.Response{Stdout: "Linux\n"})
+	// the go client prefers ecdsa, known_hosts only lists the ed25519 key
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdsaKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddHostKey(ecdsaKey)
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(server.Addr)}, server.HostKey.PublicKey())
+	if err := os.WriteFile(path, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	client.HostKeyCallback = nil
+	client.KnownHostsPath = path
+	if result, err := client.Run(context.Background(), "uname"); err != nil || string(result.Stdout) != "Linux\n" {
+		t.Fatalf("Run = %+v, %v", result, err)
+	}
+}
+
+func TestClient_Signers(t *testing.T) {
+	private, pub := newTestKey(t)
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(private, "", []byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &Client{PrivateKey: pem.EncodeToMemory(block)}
+	if _, err := client.signers(); err == nil {
+		t.Errorf("expected an error without passphrase")
+	}
+	client.Passphrase = "secret"
+	signers, err := client.signers()
+	if err != nil || len(signers) != 1 {
+		t.Fatalf("signers = %v, %v", signers, err)
+	}
+	if string(signers[0].PublicKey().Marshal()) != string(pub.Marshal()) {
+		t.Errorf("signer does not match the key")
+	}
+}
+
+func TestSocksConnect(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	target, _ := net.Pipe()
+	var dialed string
+	done := make(chan error, 1)
+	go func() {
+		_, err := socksConnect(server, func(addr string) (net.Conn, error) {
+			dialed = addr
+			return target, nil
+		})
+		done <- err
+	}()
+
+	client.Write([]byte{5, 1, 0})
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(client, reply[:2]); err != nil || reply[1] != 0 {
+		t.Fatalf("method reply = %v, %v", reply[:2], err)
+	}
+	client.Write(append([]byte{5, 1, 0, 3, 9}, "db.intern\x0c\x38"...))
+	if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0 {
+		t.Fatalf("connect reply = %v, %v", reply, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if dialed != "db.intern:3128" {
+		t.Errorf("dialed %q", dialed)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var mu sync.Mutex
+	var lines []Line
+	w := &lineWriter{stream: StreamStderr, mu: &mu, fn: func(line Line) { lines = append(lines, line) }}
+	w.Write([]byte("one\r\ntw"))
+	w.Write([]byte("o\nthree"))
+	w.Flush()
+	if len(lines) != 3 || lines[0].Text != "one" || lines[1].Text != "two" || lines[2].Text != "three" || lines[2].Stream != StreamStderr {
+		t.Errorf("lines = %v", lines)
+	}
+}
+
+func TestCastRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	recorder, err := NewCastRecorder(&buf, 80, 24, "xterm", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snowman := []byte("☃")
+	recorder.Output(append([]byte("a"), snowman[:1]...))
+	recorder.Output(snowman[1:])
+	recorder.Resize(120, 40)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[0], `{"version":2,"width":80,"height":24,`) {
+		t.Fatalf("cast = %q", buf.String())
+	}
+	var event []any
+	for i, want := range []string{"a", "☃", "120x40"} {
+		if err := json.Unmarshal([]byte(lines[i+1]), &event); err != nil || event[2] != want {
+			t.Errorf("event %d = %v, %v", i, event, err)
+		}
+	}
+}
+
+func newTestServer(t *testing.T) (*sshtest.Server, *Client) {
+	t.Helper()
+	server, err := sshtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { server.Close() })
+	server.AddPassword("ops", "secret")
+	client := &Client{
+		Timeout:         5,
+		Host:            server.Host,
+		Port:            server.Port,
+		User:            "ops",
+		Password:        "secret",
+		HostKeyCallback: ssh.FixedHostKey(server.HostKey.PublicKey()),
+	}
+	return server, client
+}
+
+func TestClient_Run(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("uname", sshtest.Response{Stdout: "Linux\n"})
+	server.Handle("check", sshtest.Response{Stdout: "checking\n", Stderr: "disk full\n", ExitStatus: 2})
+	server.Handle("crash", sshtest.Response{Signal: "SEGV"})
+
+	result, err := client.Run(context.Background(), "uname")
+	if err != nil || !result.Success() || string(result.Stdout) != "Linux\n" {
+		t.Fatalf("uname = %+v, %v", result, err)
+	}
+	result, err = client.Run(context.Background(), "check")
+	if err != nil || result.ExitCode != 2 || string(result.Stdout) != "checking\n" || string(result.Stderr) != "disk full\n" {
+		t.Fatalf("check = %+v, %v", result, err)
+	}
+	result, err = client.Run(context.Background(), "crash")
+	if err != nil || result.Signal != "SEGV" || result.ExitCode != -1 || result.Success() {
+		t.Fatalf("crash = %+v, %v", result, err)
+	}
+	output, err := client.RunCommand("check")
+	if err == nil || !strings.Contains(output, "checking\n") || !strings.Contains(output, "disk full\n") {
+		t.Fatalf("RunCommand = %q, %v", output, err)
+	}
+}
+
+func TestClient_RunTimeout(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("sleep", sshtest.Response{Delay: time.Minute})
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*300)
+	defer cancel()
+	start := time.Now()
+	result, err := client.Run(ctx, "sleep")
+	if !errors.Is(err, context.DeadlineExceeded) || !result.TimedOut {
+		t.Fatalf("sleep = %+v, %v", result, err)
+	}
+	if time.Since(start) > time.Second*5 {
+		t.Errorf("cancel took %v", time.Since(start))
+	}
+}
+
+func TestClient_KeyAuth(t *testing.T) {
+	server, client := newTestServer(t)
+	private, pub := newTestKey(t)
+	server.AddKey("deploy", pub)
+	server.Handle("id", sshtest.Response{Stdout: "deploy\n"})
+	block, err := ssh.MarshalPrivateKey(private, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.User, client.Password, client.PrivateKey = "deploy", "", pem.EncodeToMemory(block)
+	if result, err := client.Run(context.Background(), "id"); err != nil || string(result.Stdout) != "deploy\n" {
+		t.Fatalf("id = %+v, %v", result, err)
+	}
+	client.User = "nobody"
+	if _, err := client.Run(context.Background(), "id"); err == nil {
+		t.Error("expected auth failure for an unknown user")
+	}
+}
+
+func TestClient_Stream(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("deploy", sshtest.Response{Stdout: "pull\nrestart\n", Stderr: "warning\n"})
+	var lines []Line
+	result, err := client.Stream(context.Background(), "deploy", func(line Line) {
+		lines = append(lines, line)
+	})
+	if err != nil || !result.Success() {
+		t.Fatalf("deploy = %+v, %v", result, err)
+	}
+	var stdout, stderr []string
+	for _, line := range lines {
+		if line.Stream == StreamStdout {
+			stdout = append(stdout, line.Text)
+		} else {
+			stderr = append(stderr, line.Text)
+		}
+	}
+	if strings.Join(stdout, ",") != "pull,restart" || strings.Join(stderr, ",") != "warning" {
+		t.Errorf("lines = %v", lines)
+	}
+
+	client.RunCommandPty("deploy")
+	if ptys := server.Ptys(); len(ptys) != 1 || ptys[0].Term != "xterm" {
+		t.Errorf("ptys = %v", ptys)
+	}
+}
+
+func TestPool(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("uptime", sshtest.Response{Stdout: "up\n"})
+	pool := NewPool(0, 0)
+	defer pool.Close()
+	client.Pool = pool
+	for i := 0; i < 3; i++ {
+		if _, err := client.RunCommand("uptime"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := server.Connections(); n != 1 {
+		t.Fatalf("connections = %d, want 1", n)
+	}
+	server.CloseConnections()
+	if _, err := client.RunCommand("uptime"); err != nil {
+		t.Fatalf("after drop: %v", err)
+	}
+	if n := server.Connections(); n != 2 {
+		t.Errorf("connections = %d, want 2", n)
+	}
+
+	// other credentials for the same user@host:port get their own connection
+	server.AddPassword("ops", "rotated")
+	other := *client
+	other.Password = "rotated"
+	if _, err := other.RunCommand("uptime"); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Connections(); n != 3 {
+		t.Errorf("connections = %d, want 3", n)
+	}
+}
+
+func TestPool_IdleWhileDialing(t *testing.T) {
+	server, client := newTestServer(t)
+	server.Handle("uptime", sshtest.Response{Stdout: "up\n"})
+	// every tick finds the connection idle
+	pool := NewPool(time.Millisecond, time.Nanosecond)
+	defer pool.Close()
+	client.Pool = pool
+	for i := 0; i < 20; i++ {
+		if _, err := client.RunCommand("uptime"); err != nil {
+			t.Fatalf("run %d: %v", i, err)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	good, client := newTestServer(t)
+	bad, _ := newTestServer(t)
+	good.Handle("systemctl is-active nginx", sshtest.Response{Stdout: "active\n"})
+	bad.Handle("systemctl is-active nginx", sshtest.Response{Stdout: "failed\n", ExitStatus: 3})
+
+	template := *client
+	template.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+	batch := &Batch{Hosts: Inventory(template, []string{good.Addr, bad.Addr, good.Addr}), Concurrency: 1, FailureThreshold: 1}
+	results := batch.Run(context.Background(), "systemctl is-active nginx")
+	if results[0].Failed() || results[0].Stdout != "active\n" {
+		t.Errorf("good = %+v", results[0])
+	}
+	if results[1].ExitStatus != 3 || results[1].Err != nil {
+		t.Errorf("bad = %+v", results[1])
+	}
+	if !errors.Is(results[2].Err, ErrSkipped) {
+		t.Errorf("after threshold = %+v", results[2])
+	}
+}
+
+func TestSFTP(t *testing.T) {
+	_, client := newTestServer(t)
+	local, remote := t.TempDir(), t.TempDir()
+	os.MkdirAll(filepath.Join(local, "conf"), 0o755)
+	os.WriteFile(filepath.Join(local, "app.bin"), bytes.Repeat([]byte("x"), 100000), 0o750)
+	os.WriteFile(filepath.Join(local, "conf", "app.yaml"), []byte("port: 80\n"), 0o644)
+	os.WriteFile(filepath.Join(remote, "stale.txt"), []byte("old"), 0o644)
+
+	session, err := client.SFTP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if err := session.UploadDir(local, remote, TransferOptions{Verify: true, Delete: true}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(remote, "conf", "app.yaml")); err != nil || string(data) != "port: 80\n" {
+		t.Errorf("uploaded = %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(remote, "app.bin")); err != nil || info.Mode().Perm() != 0o750 {
+		t.Errorf("mode = %v, %v", info, err)
+	}
+	if _, err := os.Stat(filepath.Join(remote, "stale.txt")); !os.IsNotExist(err) {
+		t.Errorf("stale file not deleted: %v", err)
+	}
+
+	var transferred int64
+	download := filepath.Join(t.TempDir(), "app.bin")
+	err = client.Download(filepath.Join(remote, "app.bin"), download, TransferOptions{
+		Verify:   true,
+		Progress: func(path string, n, total int64) { transferred = n },
+	})
+	if err != nil || transferred != 100000 {
+		t.Fatalf("download = %d, %v", transferred, err)
+	}
+
+	// corrupt the temp file once everything is read, the destination must survive
+	os.WriteFile(download, []byte("old"), 0o644)
+	err = client.Download(filepath.Join(remote, "app.bin"), download, TransferOptions{
+		Verify: true,
+		Progress: func(path string, n, total int64) {
+			if n < total {
+				return
+			}
+			temps, _ := filepath.Glob(filepath.Join(filepath.Dir(download), ".app.bin*"))
+			for _, temp := range temps {
+				if file, err := os.OpenFile(temp, os.O_WRONLY, 0); err == nil {
+					file.WriteAt([]byte("y"), 0)
+					file.Close()
+				}
+			}
+		},
+	})
+	var mismatch *ChecksumError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("corrupted download = %v", err)
+	}
+	if data, err := os.ReadFile(download); err != nil || string(data) != "old" {
+		t.Errorf("destination = %.10q, %v", data, err)
+	}
+	if temps, _ := filepath.Glob(filepath.Join(filepath.Dir(download), ".app.bin*")); len(temps) != 0 {
+		t.Errorf("temp files left: %v", temps)
+	}
+}
+
+func TestClient_Jump(t *testing.T) {
+	bastion, hop := newTestServer(t)
+	target, client := newTestServer(t)
+	target.Handle("hostname", sshtest.Response{Stdout: "db1\n"})
+	client.Jump = []*Client{hop}
+	result, err := client.Run(context.Background(), "hostname")
+	if err != nil || string(result.Stdout) != "db1\n" {
+		t.Fatalf("hostname = %+v, %v", result, err)
+	}
+	if bastion.Connections() != 1 || target.Connections() != 1 {
+		t.Errorf("connections bastion %d, target %d", bastion.Connections(), target.Connections())
+	}
+}
+
+// echoServer answers every connection with what it reads.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echo(t *testing.T, conn net.Conn, message string) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second * 5))
+	if _, err := io.WriteString(conn, message); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(message))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != message {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestForward(t *testing.T) {
+	_, client := newTestServer(t)
+	target := echoServer(t)
+
+	local, err := client.LocalForward("127.0.0.1:0", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	conn, err := net.Dial("tcp", local.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "ping")
+	if stats := local.Stats(); stats.Total != 1 || stats.Upstream != 4 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	remote, err := client.RemoteForward("127.0.0.1:0", target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+	conn, err = net.Dial("tcp", remote.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, "pong")
+
+	dynamic, err := client.DynamicForward("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err = net.Dial("tcp", dynamic.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port, _ := net.SplitHostPort(target)
+	portNum, _ := strconv.Atoi(port)
+	request := append([]byte{5, 1, 0, 5, 1, 0, 1}, net.ParseIP(host).To4()...)
+	conn.Write(append(request, byte(portNum>>8), byte(portNum)))
+	reply := make([]byte, 12)
+	if _, err := io.ReadFull(conn, reply); err != nil || reply[1] != 0 || reply[3] != 0 {
+		t.Fatalf("socks reply = %v, %v", reply, err)
+	}
+	echo(t, conn, "socks")
+
+	dynamic.Close()
+	select {
+	case <-dynamic.Done():
+	case <-time.After(time.Second * 5):
+		t.Fatal("forward did not stop")
+	}
+	if dynamic.Err() != nil {
+		t.Errorf("err after Close = %v", dynamic.Err())
+	}
+}
+
+func TestTerminalHandler(t *testing.T) {
+	server, client := newTestServer(t)
+	dir := t.TempDir()
+	http := httptest.NewServer(&TerminalHandler{Client: client, RecordDir: dir, IdleTimeout: time.Second * 5})
+	defer http.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(http.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.WriteJSON(TerminalMessage{Type: "resize", Rows: 40, Cols: 120})
+	conn.WriteMessage(websocket.BinaryMessage, []byte("ls\r"))
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var output []byte
+	for !bytes.Contains(output, []byte("ls\r")) {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("read: %v, got %q", err, output)
+		}
+		output = append(output, data...)
+	}
+	conn.WriteJSON(TerminalMessage{Type: "input", Data: "exit\r"})
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			break
+		}
+	}
+	conn.Close()
+
+	if ptys := server.Ptys(); len(ptys) != 2 || ptys[0].Cols != 80 || ptys[1].Cols != 120 {
+		t.Errorf("ptys = %v", ptys)
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		casts, _ := filepath.Glob(filepath.Join(dir, "*.cast"))
+		var data []byte
+		if len(casts) == 1 {
+			data, _ = os.ReadFile(casts[0])
+		}
+		if bytes.Contains(data, []byte(`"i","exit\r"`)) && bytes.Contains(data, []byte(`"r","120x40"`)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cast = %q", data)
+		}
+		time.Sleep(time.Millisecond * 20)
+	}
+}
@@ -0,0 +1,341 @@
+package ssh
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrConnectionLost stops a forward when its ssh connection closes.
+var ErrConnectionLost = errors.New("ssh connection lost")
+
+// ForwardStats counts the connections of a forward, bytes are counted as they are copied.
+type ForwardStats struct {
+	Active int64
+	Total  int64
+
+	// Upstream is copied from the accepted connections to the targets, Downstream back
+	Upstream   int64
+	Downstream int64
+}
+
+// Forward is a running port forward, see LocalForward, RemoteForward and DynamicForward.
+// It runs until Close or until the ssh connection is lost.
+type Forward struct {
+	listener net.Listener
+	open     func(conn net.Conn) (net.Conn, error)
+	release  func()
+
+	active     atomic.Int64
+	total      atomic.Int64
+	upstream   atomic.Int64
+	downstream atomic.Int64
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	err    error
+	once   sync.Once
+	wg     sync.WaitGroup
+	done   chan struct{}
+}
+
+// LocalForward listens on localAddr and connects every accepted connection to
+// remoteAddr from the server, like ssh -L.
+func (c *Client) LocalForward(localAddr, remoteAddr string) (*Forward, error) {
+	client, release, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return newForward(client, listener, release, func(net.Conn) (net.Conn, error) {
+		return client.Dial("tcp", remoteAddr)
+	}), nil
+}
+
+// RemoteForward listens on remoteAddr on the server and connects every accepted
+// connection to localAddr, like ssh -R.
+func (c *Client) RemoteForward(remoteAddr, localAddr string) (*Forward, error) {
+	client, release, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := client.Listen("tcp", remoteAddr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return newForward(client, listener, release, func(net.Conn) (net.Conn, error) {
+		return net.DialTimeout("tcp", localAddr, time.Second*10)
+	}), nil
+}
+
+// DynamicForward runs a SOCKS5 proxy on localAddr whose CONNECT requests are
+// dialed from the server, like ssh -D.
+func (c *Client) DynamicForward(localAddr string) (*Forward, error) {
+	client, release, err := c.conn()
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return newForward(client, listener, release, func(conn net.Conn) (net.Conn, error) {
+		return socksConnect(conn, func(addr string) (net.Conn, error) {
+			return client.Dial("tcp", addr)
+		})
+	}), nil
+}
+
+func newForward(client *ssh.Client, listener net.Listener, release func(), open func(net.Conn) (net.Conn, error)) *Forward {
+	f := &Forward{
+		listener: listener,
+		open:     open,
+		release:  release,
+		conns:    map[net.Conn]struct{}{},
+		done:     make(chan struct{}),
+	}
+	go f.serve()
+	go func() {
+		client.Wait()
+		f.shutdown(ErrConnectionLost)
+	}()
+	return f
+}
+
+// Addr is the listening address, on the server for a remote forward.
+func (f *Forward) Addr() net.Addr {
+	return f.listener.Addr()
+}
+
+func (f *Forward) Stats() ForwardStats {
+	return ForwardStats{
+		Active:     f.active.Load(),
+		Total:      f.total.Load(),
+		Upstream:   f.upstream.Load(),
+		Downstream: f.downstream.Load(),
+	}
+}
+
+// Done is closed once the forward stopped and its connections are closed.
+func (f *Forward) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns why the forward stopped, nil while running or after Close.
+func (f *Forward) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close stops listening and closes the forwarded connections.
+func (f *Forward) Close() error {
+	f.shutdown(nil)
+	return nil
+}
+
+func (f *Forward) shutdown(err error) {
+	f.once.Do(func() {
+		f.mu.Lock()
+		f.closed = true
+		f.err = err
+		conns := f.conns
+		f.conns = nil
+		f.mu.Unlock()
+		f.listener.Close()
+		for conn := range conns {
+			conn.Close()
+		}
+		f.wg.Wait()
+		f.release()
+		close(f.done)
+	})
+}
+
+func (f *Forward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			f.shutdown(err)
+			return
+		}
+		if !f.track(conn) {
+			conn.Close()
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+// track registers conn for Close, false once the forward is closed.
+func (f *Forward) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	f.wg.Add(1)
+	return true
+}
+
+func (f *Forward) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+}
+
+func (f *Forward) handle(conn net.Conn) {
+	defer f.wg.Done()
+	defer f.untrack(conn)
+	defer conn.Close()
+	f.total.Add(1)
+	f.active.Add(1)
+	defer f.active.Add(-1)
+
+	target, err := f.open(conn)
+	if err != nil {
+		return
+	}
+	defer target.Close()
+	copied := make(chan struct{})
+	go func() {
+		defer close(copied)
+		forwardCopy(target, conn, &f.upstream)
+	}()
+	forwardCopy(conn, target, &f.downstream)
+	<-copied
+}
+
+// forwardCopy half-closes dst once src is drained so the other direction can finish.
+func forwardCopy(dst, src net.Conn, count *atomic.Int64) {
+	_, err := io.Copy(&countWriter{dst, count}, src)
+	if closer, ok := dst.(interface{ CloseWrite() error }); ok && err == nil {
+		closer.CloseWrite()
+		return
+	}
+	dst.Close()
+	src.Close()
+}
+
+type countWriter struct {
+	io.Writer
+	count *atomic.Int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.count.Add(int64(n))
+	return n, err
+}
+
+const (
+	socksVersion      = 5
+	socksNoAuth       = 0
+	socksNoAcceptable = 0xff
+	socksConnectCmd   = 1
+	socksIPv4         = 1
+	socksDomain       = 3
+	socksIPv6         = 4
+
+	socksSucceeded           = 0
+	socksGeneralFailure      = 1
+	socksCommandNotSupported = 7
+	socksAddressNotSupported = 8
+)
+
+// socksConnect serves the SOCKS5 handshake on conn, unauthenticated CONNECT only,
+// and returns the target opened by dial.
+func socksConnect(conn net.Conn, dial func(addr string) (net.Conn, error)) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(time.Second * 30))
+	defer conn.SetDeadline(time.Time{})
+
+	buf := make([]byte, 258)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if buf[0] != socksVersion {
+		return nil, fmt.Errorf("socks: unsupported version %d", buf[0])
+	}
+	methods := buf[2 : 2+int(buf[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	noAuth := false
+	for _, method := range methods {
+		noAuth = noAuth || method == socksNoAuth
+	}
+	if !noAuth {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return nil, errors.New("socks: client requires authentication")
+	}
+	if _, err := conn.Write([]byte{socksVersion, socksNoAuth}); err != nil {
+		return nil, err
+	}
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	if buf[1] != socksConnectCmd {
+		socksReply(conn, socksCommandNotSupported)
+		return nil, fmt.Errorf("socks: unsupported command %d", buf[1])
+	}
+	var host string
+	switch buf[3] {
+	case socksIPv4, socksIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if buf[3] == socksIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = ip.String()
+	case socksDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		name := buf[1 : 1+int(buf[0])]
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		socksReply(conn, socksAddressNotSupported)
+		return nil, fmt.Errorf("socks: unsupported address type %d", buf[3])
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(host, strconv.Itoa(int(buf[0])<<8|int(buf[1])))
+
+	target, err := dial(addr)
+	if err != nil {
+		socksReply(conn, socksGeneralFailure)
+		return nil, err
+	}
+	if err := socksReply(conn, socksSucceeded); err != nil {
+		target.Close()
+		return nil, err
+	}
+	return target, nil
+}
+
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
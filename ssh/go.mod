@@ -2,5 +2,14 @@ module github.com/Nname/gtools/ssh
 
 go 1.22.1
 
-require golang.org/x/crypto v0.25.0
-require golang.org/x/sys v0.22.0 // indirect
+require (
+	github.com/gorilla/websocket v1.5.3
+	github.com/pkg/sftp v1.13.6
+	github.com/skeema/knownhosts v1.2.2
+	golang.org/x/crypto v0.25.0
+)
+
+require (
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+)
@@ -0,0 +1,246 @@
+package ssh
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrPoolClosed = errors.New("ssh pool closed")
+
+// Pool keeps one connection per user@host:port, credentials, host key settings
+// and Jump chain, and opens a session on it per command. HostKeyCallback and
+// KeyboardInteractive are functions and not part of the key, Clients that only
+// differ there share a connection. Broken connections are dropped and redialed
+// on the next use. A Pool is safe for concurrent use.
+type Pool struct {
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*pooledConn
+	closed bool
+	stop   chan struct{}
+}
+
+type pooledConn struct {
+	mu       sync.Mutex // held while dialing
+	client   *ssh.Client
+	lastUsed time.Time
+	sessions int
+	removed  bool // taken out of conns by Close, guarded by Pool.mu
+}
+
+// NewPool starts a pool sending keepalives every keepAlive and closing
+// connections without sessions for idleTimeout, zero values mean 30s and 5m.
+func NewPool(keepAlive, idleTimeout time.Duration) *Pool {
+	if keepAlive <= 0 {
+		keepAlive = time.Second * 30
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = time.Minute * 5
+	}
+	p := &Pool{KeepAlive: keepAlive, IdleTimeout: idleTimeout, conns: map[string]*pooledConn{}, stop: make(chan struct{})}
+	go p.maintain()
+	return p
+}
+
+func poolKey(c *Client) string {
+	hash := sha256.New()
+	for _, hop := range append([]*Client{c}, c.Jump...) {
+		fmt.Fprintf(hash, "%q %q %q %q %q %q %q %q %q %t %t %t\n", hop.User, hop.address(), hop.Password,
+			hop.PrivateKey, hop.PrivateKeyPath, hop.Passphrase, hop.Certificate, hop.CertificatePath,
+			hop.KnownHostsPath, hop.TrustOnFirstUse, hop.UseAgent, hop.ForwardAgent)
+	}
+	return fmt.Sprintf("%s@%s/%x", c.User, c.address(), hash.Sum(nil)[:8])
+}
+
+// get returns the live connection for c, dialing it when needed. The caller
+// counts as a session from the start, so maintain does not close the entry
+// while it is dialed, and has to release it.
+func (p *Pool) get(c *Client) (*pooledConn, *ssh.Client, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, nil, ErrPoolClosed
+	}
+	key := poolKey(c)
+	conn, ok := p.conns[key]
+	if !ok {
+		conn = &pooledConn{}
+		p.conns[key] = conn
+	}
+	conn.sessions++
+	p.mu.Unlock()
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	client := conn.client
+	if client == nil {
+		var err error
+		if client, err = c.dial(); err != nil {
+			p.release(conn)
+			return nil, nil, err
+		}
+	}
+	p.mu.Lock()
+	removed := conn.removed
+	p.mu.Unlock()
+	if removed {
+		// Close took the entry while dialing
+		if client != conn.client {
+			client.Close()
+		}
+		p.release(conn)
+		return nil, nil, ErrPoolClosed
+	}
+	if conn.client == nil {
+		conn.client = client
+		go func() {
+			client.Wait()
+			p.drop(conn, client)
+		}()
+	}
+	return conn, client, nil
+}
+
+// release ends a session counted by get.
+func (p *Pool) release(conn *pooledConn) {
+	p.mu.Lock()
+	conn.sessions--
+	conn.lastUsed = time.Now()
+	p.mu.Unlock()
+}
+
+// drop forgets client if it is still the current connection of conn.
+func (p *Pool) drop(conn *pooledConn, client *ssh.Client) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.client == client {
+		conn.client = nil
+	}
+	client.Close()
+}
+
+// Session opens a session on the pooled connection for c, redialing once if
+// the connection turned out to be dead. release closes the session.
+func (p *Pool) Session(c *Client) (session *ssh.Session, release func(), err error) {
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *pooledConn
+		var client *ssh.Client
+		conn, client, err = p.get(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		session, err = c.newSession(client)
+		if err != nil {
+			p.release(conn)
+			p.drop(conn, client)
+			continue
+		}
+		var once sync.Once
+		release = func() {
+			once.Do(func() {
+				session.Close()
+				p.release(conn)
+			})
+		}
+		return session, release, nil
+	}
+	return nil, nil, err
+}
+
+// Conn borrows the pooled connection for c, it is not closed as idle until release.
+func (p *Pool) Conn(c *Client) (client *ssh.Client, release func(), err error) {
+	conn, client, err := p.get(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	var once sync.Once
+	return client, func() {
+		once.Do(func() { p.release(conn) })
+	}, nil
+}
+
+// maintain sends keepalives and closes idle connections until Close.
+func (p *Pool) maintain() {
+	ticker := time.NewTicker(p.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+		}
+		p.mu.Lock()
+		conns := make([]*pooledConn, 0, len(p.conns))
+		for key, conn := range p.conns {
+			if conn.sessions == 0 && time.Since(conn.lastUsed) > p.IdleTimeout {
+				delete(p.conns, key)
+				go p.closeConn(conn)
+				continue
+			}
+			conns = append(conns, conn)
+		}
+		p.mu.Unlock()
+		for _, conn := range conns {
+			conn.mu.Lock()
+			client := conn.client
+			conn.mu.Unlock()
+			if client != nil {
+				go p.keepAlive(conn, client)
+			}
+		}
+	}
+}
+
+// keepAlive drops the connection when the server does not answer within one interval.
+func (p *Pool) keepAlive(conn *pooledConn, client *ssh.Client) {
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+	select {
+	case err := <-reply:
+		if err != nil {
+			p.drop(conn, client)
+		}
+	case <-time.After(p.KeepAlive):
+		p.drop(conn, client)
+	}
+}
+
+func (p *Pool) closeConn(conn *pooledConn) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.client != nil {
+		conn.client.Close()
+		conn.client = nil
+	}
+}
+
+// Close closes every connection, later calls return ErrPoolClosed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.stop)
+	conns := p.conns
+	p.conns = map[string]*pooledConn{}
+	for _, conn := range conns {
+		conn.removed = true
+	}
+	p.mu.Unlock()
+	for _, conn := range conns {
+		p.closeConn(conn)
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package ssh
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+)
+
+// Result is the outcome of a remote command.
+type Result struct {
+	Stdout []byte
+	Stderr []byte
+
+	// ExitCode is -1 when the server sent no exit status, e.g. after a signal
+	ExitCode int
+	// Signal is the name of the signal that killed the command, without the SIG prefix
+	Signal string
+	// TimedOut is set when the context deadline expired before the command exited
+	TimedOut bool
+
+	Duration time.Duration
+}
+
+// Success reports whether the command exited with status 0.
+func (r *Result) Success() bool {
+	return r != nil && r.ExitCode == 0 && r.Signal == "" && !r.TimedOut
+}
+
+// Line is one line of output of Stream.
+type Line struct {
+	Stream string
+	Text   string
+}
+
+// Run executes command with separate stdout and stderr. A non-zero exit is
+// reported in the Result with a nil error; when ctx ends first the command is
+// killed and the output so far is returned with ctx.Err().
+func (c *Client) Run(ctx context.Context, command string) (*Result, error) {
+	var stdout, stderr bytes.Buffer
+	result, err := c.execute(ctx, command, false, &stdout, &stderr)
+	result.Stdout = stdout.Bytes()
+	result.Stderr = stderr.Bytes()
+	return result, err
+}
+
+// Stream executes command and calls fn for every line of both streams as it
+// arrives, never concurrently. The Result carries no output.
+func (c *Client) Stream(ctx context.Context, command string, fn func(Line)) (*Result, error) {
+	return c.stream(ctx, command, false, fn)
+}
+
+func (c *Client) stream(ctx context.Context, command string, pty bool, fn func(Line)) (*Result, error) {
+	var mu sync.Mutex
+	stdout := &lineWriter{stream: StreamStdout, mu: &mu, fn: fn}
+	stderr := &lineWriter{stream: StreamStderr, mu: &mu, fn: fn}
+	result, err := c.execute(ctx, command, pty, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	return result, err
+}
+
+// execute runs command on a session from session(), the returned Result is never nil.
+func (c *Client) execute(ctx context.Context, command string, pty bool, stdout, stderr io.Writer) (*Result, error) {
+	start := time.Now()
+	result := &Result{ExitCode: -1}
+	finish := func(err error) (*Result, error) {
+		result.Duration = time.Since(start)
+		result.TimedOut = errors.Is(err, context.DeadlineExceeded)
+		return result, err
+	}
+
+	type opened struct {
+		session *ssh.Session
+		release func()
+		err     error
+	}
+	ch := make(chan opened, 1)
+	go func() {
+		session, release, err := c.session()
+		ch <- opened{session, release, err}
+	}()
+	var open opened
+	select {
+	case open = <-ch:
+	case <-ctx.Done():
+		go func() {
+			if open := <-ch; open.err == nil {
+				open.release()
+			}
+		}()
+		return finish(ctx.Err())
+	}
+	if open.err != nil {
+		return finish(open.err)
+	}
+	defer open.release()
+
+	if pty {
+		if err := open.session.RequestPty("xterm", 120, 120, ssh.TerminalModes{}); err != nil {
+			return finish(err)
+		}
+	}
+	open.session.Stdout = stdout
+	open.session.Stderr = stderr
+	if err := open.session.Start(command); err != nil {
+		return finish(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- open.session.Wait() }()
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		open.session.Signal(ssh.SIGKILL)
+		open.release()
+		<-done
+		return finish(ctx.Err())
+	}
+
+	var exitErr *ssh.ExitError
+	var missingErr *ssh.ExitMissingError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+		return finish(nil)
+	case errors.As(err, &exitErr):
+		result.Signal = exitErr.Signal()
+		if result.Signal == "" {
+			result.ExitCode = exitErr.ExitStatus()
+		}
+		return finish(nil)
+	case errors.As(err, &missingErr):
+		return finish(nil)
+	default:
+		return finish(err)
+	}
+}
+
+// lineWriter splits writes into lines for fn, mu is shared by the writers of one command.
+type lineWriter struct {
+	stream string
+	mu     *sync.Mutex
+	fn     func(Line)
+	buf    []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.fn(Line{Stream: w.stream, Text: string(bytes.TrimSuffix(w.buf[:i], []byte("\r")))})
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// Flush delivers a last line without newline.
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.fn(Line{Stream: w.stream, Text: string(bytes.TrimSuffix(w.buf, []byte("\r")))})
+		w.buf = nil
+	}
+}
@@ -0,0 +1,341 @@
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/sftp"
+)
+
+// ChecksumError is returned when a transferred file does not hash to its source.
+type ChecksumError struct {
+	Path string
+	Want string
+	Got  string
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch for %s: want sha256 %s, got %s", e.Path, e.Want, e.Got)
+}
+
+// TransferOptions tune Upload, Download and the directory variants.
+type TransferOptions struct {
+	// Progress is called after every chunk with the bytes copied so far
+	Progress func(path string, transferred, total int64)
+
+	// Verify re-reads the temp file before it is renamed into place and compares
+	// its sha256, on a mismatch the destination is left alone
+	Verify bool
+
+	// Delete removes destination files that are missing from the source, directory sync only
+	Delete bool
+}
+
+// SFTP is an sftp session on the connection of a Client.
+type SFTP struct {
+	*sftp.Client
+	release func()
+}
+
+// SFTP opens the sftp subsystem on a session from Pool, or on a new connection.
+func (c *Client) SFTP() (*SFTP, error) {
+	session, release, err := c.session()
+	if err != nil {
+		return nil, err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		release()
+		return nil, err
+	}
+	client, err := sftp.NewClientPipe(stdout, stdin)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	return &SFTP{Client: client, release: release}, nil
+}
+
+func (s *SFTP) Close() error {
+	err := s.Client.Close()
+	s.release()
+	return err
+}
+
+// Upload copies a local file to remote through a temp file renamed into place, keeping its mode and mtime.
+func (s *SFTP) Upload(local, remote string, opts TransferOptions) error {
+	src, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	tmp := path.Join(path.Dir(remote), tempName(path.Base(remote)))
+	dst, err := s.Create(tmp)
+	if err != nil {
+		return err
+	}
+	sum := sha256.New()
+	_, err = io.Copy(dst, progressReader(io.TeeReader(src, sum), remote, info.Size(), opts.Progress))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = s.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		err = s.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil && opts.Verify {
+		var file *sftp.File
+		if file, err = s.Open(tmp); err == nil {
+			err = verify(remote, sum, file)
+			file.Close()
+		}
+	}
+	if err == nil {
+		err = s.rename(tmp, remote)
+	}
+	if err != nil {
+		s.Remove(tmp)
+	}
+	return err
+}
+
+// Download copies a remote file to local through a temp file renamed into place, keeping its mode and mtime.
+func (s *SFTP) Download(remote, local string, opts TransferOptions) error {
+	src, err := s.Open(remote)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+
+	dst, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+"*")
+	if err != nil {
+		return err
+	}
+	tmp := dst.Name()
+	sum := sha256.New()
+	_, err = io.Copy(dst, progressReader(io.TeeReader(src, sum), remote, info.Size(), opts.Progress))
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, info.Mode().Perm())
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil && opts.Verify {
+		var file *os.File
+		if file, err = os.Open(tmp); err == nil {
+			err = verify(local, sum, file)
+			file.Close()
+		}
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// UploadDir makes remoteDir mirror localDir, skipping files whose size and mtime already match.
+func (s *SFTP) UploadDir(localDir, remoteDir string, opts TransferOptions) error {
+	seen := map[string]bool{}
+	err := filepath.WalkDir(localDir, func(local string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(localDir, local)
+		if err != nil {
+			return err
+		}
+		remote := path.Join(remoteDir, filepath.ToSlash(rel))
+		seen[remote] = true
+		if entry.IsDir() {
+			return s.MkdirAll(remote)
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if remoteInfo, err := s.Stat(remote); err == nil && sameFile(info, remoteInfo) {
+			return nil
+		}
+		return s.Upload(local, remote, opts)
+	})
+	if err != nil || !opts.Delete {
+		return err
+	}
+	walker := s.Walk(remoteDir)
+	var stale []string
+	for walker.Step() {
+		if walker.Err() != nil {
+			return walker.Err()
+		}
+		if !seen[path.Clean(walker.Path())] {
+			stale = append(stale, walker.Path())
+			if walker.Stat().IsDir() {
+				walker.SkipDir()
+			}
+		}
+	}
+	for _, remote := range stale {
+		if err := s.RemoveAll(remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DownloadDir makes localDir mirror remoteDir, skipping files whose size and mtime already match.
+func (s *SFTP) DownloadDir(remoteDir, localDir string, opts TransferOptions) error {
+	seen := map[string]bool{}
+	walker := s.Walk(remoteDir)
+	for walker.Step() {
+		if walker.Err() != nil {
+			return walker.Err()
+		}
+		rel := strings.TrimPrefix(path.Clean(walker.Path()), path.Clean(remoteDir))
+		local := filepath.Join(localDir, filepath.FromSlash(rel))
+		seen[local] = true
+		info := walker.Stat()
+		if info.IsDir() {
+			if err := os.MkdirAll(local, 0o755); err != nil {
+				return err
+			}
+			continue
+		}
+		if !info.Mode().IsRegular() {
+			continue
+		}
+		if localInfo, err := os.Stat(local); err == nil && sameFile(info, localInfo) {
+			continue
+		}
+		if err := s.Download(walker.Path(), local, opts); err != nil {
+			return err
+		}
+	}
+	if !opts.Delete {
+		return nil
+	}
+	return filepath.WalkDir(localDir, func(local string, entry fs.DirEntry, err error) error {
+		if err != nil || seen[filepath.Clean(local)] {
+			return err
+		}
+		if err := os.RemoveAll(local); err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// rename replaces newname, through posix-rename when the server supports it.
+func (s *SFTP) rename(oldname, newname string) error {
+	if _, ok := s.HasExtension("posix-rename@openssh.com"); ok {
+		return s.PosixRename(oldname, newname)
+	}
+	s.Remove(newname)
+	return s.Rename(oldname, newname)
+}
+
+func sameFile(a, b os.FileInfo) bool {
+	return a.Size() == b.Size() && a.ModTime().Unix() == b.ModTime().Unix()
+}
+
+func tempName(base string) string {
+	buf := make([]byte, 6)
+	rand.Read(buf)
+	return fmt.Sprintf(".%s.%s.tmp", base, hex.EncodeToString(buf))
+}
+
+func verify(name string, want hash.Hash, file io.Reader) error {
+	got := sha256.New()
+	if _, err := io.Copy(got, file); err != nil {
+		return err
+	}
+	if !bytes.Equal(want.Sum(nil), got.Sum(nil)) {
+		return &ChecksumError{Path: name, Want: hex.EncodeToString(want.Sum(nil)), Got: hex.EncodeToString(got.Sum(nil))}
+	}
+	return nil
+}
+
+type progress struct {
+	reader      io.Reader
+	path        string
+	total       int64
+	transferred int64
+	report      func(path string, transferred, total int64)
+}
+
+func progressReader(reader io.Reader, path string, total int64, report func(string, int64, int64)) io.Reader {
+	if report == nil {
+		return reader
+	}
+	return &progress{reader: reader, path: path, total: total, report: report}
+}
+
+func (p *progress) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	if n > 0 {
+		p.transferred += int64(n)
+		p.report(p.path, p.transferred, p.total)
+	}
+	return n, err
+}
+
+// Upload copies one file over a short-lived sftp session, see SFTP.Upload.
+func (c *Client) Upload(local, remote string, opts TransferOptions) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Upload(local, remote, opts)
+}
+
+// Download copies one file over a short-lived sftp session, see SFTP.Download.
+func (c *Client) Download(remote, local string, opts TransferOptions) error {
+	client, err := c.SFTP()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Download(remote, local, opts)
+}
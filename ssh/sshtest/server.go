@@ -0,0 +1,520 @@
+// Package sshtest provides an in-process SSH server for tests, in the spirit of
+// net/http/httptest.
+package sshtest
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Response is the scripted outcome of an exec request.
+type Response struct {
+	Stdout     string
+	Stderr     string
+	ExitStatus int
+
+	// Delay holds the command before it answers, a signal from the client ends it early
+	Delay time.Duration
+	// Signal ends the command with exit-signal instead of ExitStatus, e.g. "TERM"
+	Signal string
+}
+
+// PtyRequest is a pty-req or window-change received by the server.
+type PtyRequest struct {
+	Term string
+	Cols int
+	Rows int
+}
+
+// Server answers exec requests from its scripted responses, echoes input back
+// on shell requests, serves sftp on the local filesystem and forwards tcp both
+// ways. An exec without a response fails with status 127.
+type Server struct {
+	Addr    string
+	Host    string
+	Port    int
+	HostKey ssh.Signer
+
+	// SFTPRoot is the working directory of the sftp subsystem
+	SFTPRoot string
+
+	listener net.Listener
+	config   *ssh.ServerConfig
+	wg       sync.WaitGroup
+
+	mu        sync.Mutex
+	passwords map[string]string
+	keys      map[string][]ssh.PublicKey
+	responses map[string]Response
+	execs     []string
+	ptys      []PtyRequest
+	conns     []net.Conn
+	accepted  int
+	closed    bool
+}
+
+// NewServer starts a server on a loopback port with a random ed25519 host key.
+func NewServer() (*Server, error) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	addr := listener.Addr().(*net.TCPAddr)
+	s := &Server{
+		Addr:      addr.String(),
+		Host:      addr.IP.String(),
+		Port:      addr.Port,
+		HostKey:   hostKey,
+		listener:  listener,
+		passwords: map[string]string{},
+		keys:      map[string][]ssh.PublicKey{},
+		responses: map[string]Response{},
+	}
+	s.config = &ssh.ServerConfig{
+		PasswordCallback:  s.checkPassword,
+		PublicKeyCallback: s.checkKey,
+	}
+	s.config.AddHostKey(hostKey)
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// AddHostKey offers key next to HostKey on new connections.
+func (s *Server) AddHostKey(key ssh.Signer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.config.AddHostKey(key)
+}
+
+// AddPassword accepts user with password.
+func (s *Server) AddPassword(user, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.passwords[user] = password
+}
+
+// AddKey accepts user with the private key of key.
+func (s *Server) AddKey(user string, key ssh.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[user] = append(s.keys[user], key)
+}
+
+// Handle scripts the response to an exec of exactly command.
+func (s *Server) Handle(command string, response Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.responses[command] = response
+}
+
+// Execs returns the commands received so far, in order.
+func (s *Server) Execs() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.execs...)
+}
+
+// Ptys returns the pty-req and window-change requests received so far, in order.
+func (s *Server) Ptys() []PtyRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]PtyRequest(nil), s.ptys...)
+}
+
+// Connections returns the number of accepted tcp connections.
+func (s *Server) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.accepted
+}
+
+// CloseConnections drops the open connections, the server keeps listening.
+func (s *Server) CloseConnections() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// Close stops listening, drops the connections and waits for their handlers.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	err := s.listener.Close()
+	s.CloseConnections()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if want, ok := s.passwords[meta.User()]; ok && want == string(password) {
+		return nil, nil
+	}
+	return nil, fmt.Errorf("password rejected for %s", meta.User())
+}
+
+func (s *Server) checkKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, known := range s.keys[meta.User()] {
+		if bytes.Equal(known.Marshal(), key.Marshal()) {
+			return nil, nil
+		}
+	}
+	return nil, fmt.Errorf("key rejected for %s", meta.User())
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.accepted++
+		s.conns = append(s.conns, conn)
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn) {
+	defer s.wg.Done()
+	defer conn.Close()
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+	go s.handleGlobal(serverConn, reqs)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for newChannel := range chans {
+		wg.Add(1)
+		go func(newChannel ssh.NewChannel) {
+			defer wg.Done()
+			switch newChannel.ChannelType() {
+			case "session":
+				s.handleSession(newChannel)
+			case "direct-tcpip":
+				s.handleDirect(newChannel)
+			default:
+				newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			}
+		}(newChannel)
+	}
+}
+
+type session struct {
+	channel ssh.Channel
+	pty     bool
+	signals chan string
+}
+
+func (s *Server) handleSession(newChannel ssh.NewChannel) {
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+	sess := &session{channel: channel, signals: make(chan string, 1)}
+	started := false
+	for req := range reqs {
+		switch req.Type {
+		case "pty-req":
+			var payload struct {
+				Term   string
+				Cols   uint32
+				Rows   uint32
+				Width  uint32
+				Height uint32
+				Modes  string
+			}
+			ok := ssh.Unmarshal(req.Payload, &payload) == nil
+			if ok {
+				sess.pty = true
+				s.recordPty(PtyRequest{Term: payload.Term, Cols: int(payload.Cols), Rows: int(payload.Rows)})
+			}
+			req.Reply(ok, nil)
+		case "window-change":
+			var payload struct {
+				Cols   uint32
+				Rows   uint32
+				Width  uint32
+				Height uint32
+			}
+			if ssh.Unmarshal(req.Payload, &payload) == nil {
+				s.recordPty(PtyRequest{Cols: int(payload.Cols), Rows: int(payload.Rows)})
+			}
+		case "signal":
+			var payload struct{ Signal string }
+			ssh.Unmarshal(req.Payload, &payload)
+			select {
+			case sess.signals <- payload.Signal:
+			default:
+			}
+		case "exec":
+			var payload struct{ Command string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.exec(sess, payload.Command)
+		case "shell":
+			if started {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.shell(sess)
+		case "subsystem":
+			var payload struct{ Name string }
+			if started || ssh.Unmarshal(req.Payload, &payload) != nil || payload.Name != "sftp" {
+				req.Reply(false, nil)
+				continue
+			}
+			started = true
+			req.Reply(true, nil)
+			go s.sftp(sess)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) recordPty(pty PtyRequest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ptys = append(s.ptys, pty)
+}
+
+func (s *Server) exec(sess *session, command string) {
+	s.mu.Lock()
+	s.execs = append(s.execs, command)
+	response, ok := s.responses[command]
+	s.mu.Unlock()
+	if !ok {
+		response = Response{Stderr: fmt.Sprintf("%s: command not found\n", command), ExitStatus: 127}
+	}
+	stderr := sess.channel.Stderr()
+	if sess.pty {
+		stderr = sess.channel
+	}
+	io.WriteString(sess.channel, response.Stdout)
+	io.WriteString(stderr, response.Stderr)
+	if response.Delay > 0 {
+		select {
+		case signal := <-sess.signals:
+			exitSignal(sess.channel, signal)
+			return
+		case <-time.After(response.Delay):
+		}
+	}
+	if response.Signal != "" {
+		exitSignal(sess.channel, response.Signal)
+		return
+	}
+	exitStatus(sess.channel, response.ExitStatus)
+}
+
+// shell echoes its input until the client closes stdin or sends "exit".
+func (s *Server) shell(sess *session) {
+	buf := make([]byte, 1024)
+	var line []byte
+	for {
+		n, err := sess.channel.Read(buf)
+		if n > 0 {
+			sess.channel.Write(buf[:n])
+			line = append(line, buf[:n]...)
+			if i := bytes.LastIndexAny(line, "\r\n"); i >= 0 {
+				if bytes.Contains(line[:i+1], []byte("exit")) {
+					break
+				}
+				line = line[i+1:]
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	exitStatus(sess.channel, 0)
+}
+
+func (s *Server) sftp(sess *session) {
+	var options []sftp.ServerOption
+	if s.SFTPRoot != "" {
+		options = append(options, sftp.WithServerWorkingDirectory(s.SFTPRoot))
+	}
+	server, err := sftp.NewServer(sess.channel, options...)
+	if err != nil {
+		exitStatus(sess.channel, 1)
+		return
+	}
+	server.Serve()
+	server.Close()
+	exitStatus(sess.channel, 0)
+}
+
+func exitStatus(channel ssh.Channel, status int) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(status)}))
+	channel.Close()
+}
+
+func exitSignal(channel ssh.Channel, signal string) {
+	channel.SendRequest("exit-signal", false, ssh.Marshal(struct {
+		Signal     string
+		CoreDumped bool
+		Error      string
+		Lang       string
+	}{Signal: signal}))
+	channel.Close()
+}
+
+// handleDirect serves direct-tcpip channels, used by Jump and local forwards.
+func (s *Server) handleDirect(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))), time.Second*5)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	channel, reqs, err := newChannel.Accept()
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	proxy(channel, conn)
+}
+
+// handleGlobal serves tcpip-forward requests, used by remote forwards.
+func (s *Server) handleGlobal(conn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	listeners := map[string]net.Listener{}
+	defer func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}()
+	for req := range reqs {
+		var payload struct {
+			Host string
+			Port uint32
+		}
+		switch req.Type {
+		case "tcpip-forward":
+			if ssh.Unmarshal(req.Payload, &payload) != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			listener, err := net.Listen("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			port := listener.Addr().(*net.TCPAddr).Port
+			listeners[net.JoinHostPort(payload.Host, strconv.Itoa(port))] = listener
+			req.Reply(true, ssh.Marshal(struct{ Port uint32 }{uint32(port)}))
+			go forwardAccept(conn, listener, payload.Host, port)
+		case "cancel-tcpip-forward":
+			if ssh.Unmarshal(req.Payload, &payload) == nil {
+				key := net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port)))
+				if listener, ok := listeners[key]; ok {
+					listener.Close()
+					delete(listeners, key)
+				}
+			}
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}
+}
+
+func forwardAccept(conn *ssh.ServerConn, listener net.Listener, host string, port int) {
+	for {
+		accepted, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		origin := accepted.RemoteAddr().(*net.TCPAddr)
+		payload := ssh.Marshal(struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}{host, uint32(port), origin.IP.String(), uint32(origin.Port)})
+		go func() {
+			channel, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				accepted.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			proxy(channel, accepted)
+		}()
+	}
+}
+
+func proxy(channel ssh.Channel, conn net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+		close(done)
+	}()
+	io.Copy(conn, channel)
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	}
+	<-done
+	channel.Close()
+	conn.Close()
+}
@@ -0,0 +1,283 @@
+package ssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/crypto/ssh"
+)
+
+// TerminalMessage is a text message from the browser. Binary messages are sent
+// to the shell as they are.
+//
+//	{"type":"input","data":"ls\r"}
+//	{"type":"resize","rows":40,"cols":120}
+type TerminalMessage struct {
+	Type string `json:"type"`
+	Data string `json:"data,omitempty"`
+	Rows int    `json:"rows,omitempty"`
+	Cols int    `json:"cols,omitempty"`
+}
+
+// TerminalHandler bridges a websocket to an interactive shell on Client, the
+// shell output is sent back as binary messages.
+type TerminalHandler struct {
+	Client   *Client
+	Upgrader websocket.Upgrader
+
+	// Term, Rows and Cols set up the pty, default xterm 24x80
+	Term string
+	Rows int
+	Cols int
+
+	// IdleTimeout closes the session when the browser sent nothing for this long, 0 never
+	IdleTimeout time.Duration
+
+	// RecordDir, when set, keeps every session as an asciinema v2 .cast file
+	RecordDir string
+}
+
+func (h *TerminalHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err := h.serve(conn, r); err != nil {
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseInternalServerErr, err.Error()), time.Now().Add(time.Second))
+	}
+}
+
+func (h *TerminalHandler) serve(conn *websocket.Conn, r *http.Request) error {
+	term, rows, cols := h.Term, h.Rows, h.Cols
+	if term == "" {
+		term = "xterm"
+	}
+	if rows <= 0 || cols <= 0 {
+		rows, cols = 24, 80
+	}
+
+	session, release, err := h.Client.session()
+	if err != nil {
+		return err
+	}
+	defer release()
+	modes := ssh.TerminalModes{ssh.ECHO: 1, ssh.TTY_OP_ISPEED: 14400, ssh.TTY_OP_OSPEED: 14400}
+	if err := session.RequestPty(term, rows, cols, modes); err != nil {
+		return err
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var recorder *CastRecorder
+	if h.RecordDir != "" {
+		file, err := h.recordFile()
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		title := fmt.Sprintf("%s@%s from %s", h.Client.User, h.Client.Host, r.RemoteAddr)
+		if recorder, err = NewCastRecorder(file, cols, rows, term, title); err != nil {
+			return err
+		}
+	}
+	if err := session.Shell(); err != nil {
+		return err
+	}
+
+	// the shell exiting ends the read loop below by closing the websocket
+	output := make(chan struct{})
+	go func() {
+		defer close(output)
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				recorder.Output(buf[:n])
+				if conn.WriteMessage(websocket.BinaryMessage, buf[:n]) != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, "shell exited"), time.Now().Add(time.Second))
+		conn.Close()
+	}()
+	go h.ping(conn, output)
+
+	for {
+		if h.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(h.IdleTimeout))
+		}
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "idle timeout"), time.Now().Add(time.Second))
+			}
+			break
+		}
+		if messageType == websocket.BinaryMessage {
+			recorder.Input(data)
+			stdin.Write(data)
+			continue
+		}
+		var message TerminalMessage
+		if json.Unmarshal(data, &message) != nil {
+			continue
+		}
+		switch message.Type {
+		case "input":
+			recorder.Input([]byte(message.Data))
+			stdin.Write([]byte(message.Data))
+		case "resize":
+			if message.Rows > 0 && message.Cols > 0 {
+				recorder.Resize(message.Cols, message.Rows)
+				session.WindowChange(message.Rows, message.Cols)
+			}
+		}
+	}
+	session.Close()
+	<-output
+	return nil
+}
+
+// ping keeps proxies from dropping a quiet terminal.
+func (h *TerminalHandler) ping(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second * 30)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second*10)) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (h *TerminalHandler) recordFile() (*os.File, error) {
+	if err := os.MkdirAll(h.RecordDir, 0o750); err != nil {
+		return nil, err
+	}
+	host := strings.NewReplacer(":", "_", "/", "_").Replace(h.Client.address())
+	pattern := fmt.Sprintf("%s-%s-*.cast", time.Now().Format("20060102-150405"), host)
+	return os.CreateTemp(filepath.Clean(h.RecordDir), pattern)
+}
+
+// CastRecorder writes a terminal session in asciinema v2 format. The methods
+// are safe for concurrent use and do nothing on a nil recorder.
+type CastRecorder struct {
+	mu      sync.Mutex
+	w       io.Writer
+	start   time.Time
+	pending map[string][]byte // incomplete utf-8 sequences per event type
+	err     error
+}
+
+type castHeader struct {
+	Version   int               `json:"version"`
+	Width     int               `json:"width"`
+	Height    int               `json:"height"`
+	Timestamp int64             `json:"timestamp"`
+	Title     string            `json:"title,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+}
+
+// NewCastRecorder writes the header for a cols x rows terminal.
+func NewCastRecorder(w io.Writer, cols, rows int, term, title string) (*CastRecorder, error) {
+	start := time.Now()
+	header, err := json.Marshal(castHeader{
+		Version:   2,
+		Width:     cols,
+		Height:    rows,
+		Timestamp: start.Unix(),
+		Title:     title,
+		Env:       map[string]string{"TERM": term},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(w, "%s\n", header); err != nil {
+		return nil, err
+	}
+	return &CastRecorder{w: w, start: start, pending: map[string][]byte{}}, nil
+}
+
+func (r *CastRecorder) Output(data []byte) {
+	r.event("o", data)
+}
+
+func (r *CastRecorder) Input(data []byte) {
+	r.event("i", data)
+}
+
+func (r *CastRecorder) Resize(cols, rows int) {
+	r.event("r", []byte(fmt.Sprintf("%dx%d", cols, rows)))
+}
+
+// Err returns the first write error, recording stops after it.
+func (r *CastRecorder) Err() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *CastRecorder) event(kind string, data []byte) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	// keep a multi-byte character split across reads for the next event
+	data = append(r.pending[kind], data...)
+	cut := len(data)
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	r.pending[kind] = append([]byte(nil), data[cut:]...)
+	if cut == 0 {
+		return
+	}
+	line, err := json.Marshal([]any{time.Since(r.start).Seconds(), kind, string(data[:cut])})
+	if err != nil {
+		r.err = err
+		return
+	}
+	_, r.err = fmt.Fprintf(r.w, "%s\n", line)
+}